@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An AdminServer represents an HTTP listener for inspecting the daemon and
+// temporarily overriding its rollout on this host.
+// The following endpoints are served:
+//
+//	GET    /rollout      the state of every version, along with overrides
+//	GET    /maintenance  whether maintenance mode is on
+//	GET    /override     the pinned versions
+//	POST   /override     pins a version (version=canary&value=0.5&ttl=10m)
+//	DELETE /override     removes a pinned version (version=canary)
+//	GET    /guard        versions forced to 0 by the guard, with reasons
+//	DELETE /guard        clears a version forced to 0 (version=canary)
+//
+// Every endpoint acts on the application named by the "application" query
+// parameter, or on the default application if it is missing.
+// Requests that change state take their other parameters from a URL-encoded
+// form in the body, never from the query string, so that following a link
+// cannot change anything.
+// The listener should only be reachable by operators.
+type AdminServer struct {
+	applications       map[string]*adminApplication
+	defaultApplication string
+	mux                *http.ServeMux
+	server             *http.Server
+	listener           net.Listener
+	mutex              *sync.Mutex
+}
+
+// An adminApplication holds what an AdminServer inspects and overrides of a
+// single application.
+type adminApplication struct {
+	rollout     Rollout
+	overrides   *OverrideRollout
+	guard       *GuardedRollout
+	maintenance *MaintenanceDaemon
+}
+
+// A rolloutResponse is the body of a response from the /rollout endpoint.
+type rolloutResponse struct {
+	Versions  map[string]VersionState `json:"versions"`
+	Values    map[string]*float64     `json:"values"`
+	Overrides map[string]Override     `json:"overrides"`
+	Tripped   map[string]string       `json:"tripped,omitempty"`
+}
+
+// NewAdminServer creates an AdminServer that listens on the given address.
+// The override rollouts, guards, and maintenance daemons are those of the
+// given applications, in the same order; the first application is the
+// default.
+// guards may be nil if no guard is in use; otherwise each guard must wrap the
+// override rollout of its application.
+func NewAdminServer(address string, applications []string, overrides []*OverrideRollout, guards []*GuardedRollout, maintenances []*MaintenanceDaemon) (*AdminServer, error) {
+	if len(applications) == 0 {
+		return nil, fmt.Errorf("no application given")
+	}
+	if len(overrides) != len(applications) || len(maintenances) != len(applications) || (guards != nil && len(guards) != len(applications)) {
+		return nil, fmt.Errorf("expected the rollouts of %v applications", len(applications))
+	}
+	listener, err := listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error creating admin listener \"%v\": %v", address, err)
+	}
+	adminServer := &AdminServer{
+		applications:       make(map[string]*adminApplication),
+		defaultApplication: applications[0],
+		mux:                http.NewServeMux(),
+		listener:           listener,
+		mutex:              &sync.Mutex{},
+	}
+	for i, name := range applications {
+		application := &adminApplication{
+			rollout:     overrides[i],
+			overrides:   overrides[i],
+			maintenance: maintenances[i],
+		}
+		if guards != nil {
+			application.guard = guards[i]
+			application.rollout = guards[i]
+		}
+		adminServer.applications[name] = application
+	}
+	adminServer.mux.HandleFunc("/rollout", adminServer.serveRollout)
+	adminServer.mux.HandleFunc("/maintenance", adminServer.serveMaintenance)
+	adminServer.mux.HandleFunc("/override", adminServer.serveOverride)
+	adminServer.mux.HandleFunc("/guard", adminServer.serveGuard)
+	server := &http.Server{
+		Handler:      adminServer.mux,
+		ReadTimeout:  4 * time.Second,
+		WriteTimeout: 4 * time.Second,
+	}
+	adminServer.server = server
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("admin: listener stopped: %v\n", err)
+		}
+	}()
+	return adminServer, nil
+}
+
+// Addr provides the address the server is listening on.
+func (adminServer *AdminServer) Addr() net.Addr {
+	return adminServer.listener.Addr()
+}
+
+// Close stops accepting requests and waits for in-flight requests to finish.
+func (adminServer *AdminServer) Close() error {
+	adminServer.mutex.Lock()
+	defer adminServer.mutex.Unlock()
+	if adminServer.server == nil {
+		return fmt.Errorf("already stopped")
+	}
+	err := adminServer.server.Shutdown(context.Background())
+	adminServer.server = nil
+	return err
+}
+
+// ServeHTTP dispatches a request to the matching endpoint.
+func (adminServer *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	adminServer.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("admin: could not encode response: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// maxFormSize is the largest form body accepted by the admin API.
+const maxFormSize = 1 << 16
+
+// readForm parses the URL-encoded form in the body of the given request.
+func readForm(r *http.Request) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil, fmt.Errorf("expected an application/x-www-form-urlencoded body")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read body: %v", err)
+	}
+	if len(data) > maxFormSize {
+		return nil, fmt.Errorf("body is too large")
+	}
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse body: %v", err)
+	}
+	return form, nil
+}
+
+// application provides the application named by the request's query string,
+// writing an error response if there is none by that name.
+func (adminServer *AdminServer) application(w http.ResponseWriter, r *http.Request) (*adminApplication, bool) {
+	name := r.URL.Query().Get("application")
+	if name == "" {
+		name = adminServer.defaultApplication
+	}
+	application, ok := adminServer.applications[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown application \"%v\"", name))
+	}
+	return application, ok
+}
+
+func (adminServer *AdminServer) serveRollout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	application, ok := adminServer.application(w, r)
+	if !ok {
+		return
+	}
+	values := make(map[string]*float64)
+	for _, name := range application.rollout.Versions() {
+		values[name] = application.rollout.Get(name)
+	}
+	response := rolloutResponse{
+		Versions:  application.overrides.States(),
+		Values:    values,
+		Overrides: application.overrides.Overrides(),
+	}
+	if application.guard != nil {
+		response.Tripped = application.guard.Tripped()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (adminServer *AdminServer) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	application, ok := adminServer.application(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"on": application.maintenance.IsOn()})
+}
+
+func (adminServer *AdminServer) serveOverride(w http.ResponseWriter, r *http.Request) {
+	application, ok := adminServer.application(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, application.overrides.Overrides())
+		return
+	}
+	if r.Method != "POST" && r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	form, err := readForm(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	name := form.Get("version")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("version is required"))
+		return
+	}
+	if r.Method == "DELETE" {
+		application.overrides.ClearOverride(name)
+		writeJSON(w, http.StatusOK, application.overrides.Overrides())
+		return
+	}
+	value, err := strconv.ParseFloat(form.Get("value"), 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse value: %v", err))
+		return
+	}
+	if value < 0 || value > 1 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("value is out of [0.0,1.0] range"))
+		return
+	}
+	ttl, err := time.ParseDuration(form.Get("ttl"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse ttl: %v", err))
+		return
+	}
+	if ttl <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("ttl must be positive"))
+		return
+	}
+	application.overrides.Override(name, value, ttl)
+	writeJSON(w, http.StatusOK, application.overrides.Overrides())
+}
+
+func (adminServer *AdminServer) serveGuard(w http.ResponseWriter, r *http.Request) {
+	application, ok := adminServer.application(w, r)
+	if !ok {
+		return
+	}
+	if application.guard == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no guard is in use"))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, application.guard.Tripped())
+	case "DELETE":
+		form, err := readForm(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		name := form.Get("version")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("version is required"))
+			return
+		}
+		application.guard.Clear(name)
+		writeJSON(w, http.StatusOK, application.guard.Tripped())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	}
+}
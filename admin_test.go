@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAdminServer(t *testing.T, rollout Rollout) (*AdminServer, *OverrideRollout, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	overrideRollout := NewOverrideRollout(rollout)
+	md, err := NewMaintenanceDaemon(path.Join(dir, "test"), &NilMonitor{}, overrideRollout)
+	if err != nil {
+		t.Fatalf("Failed creating MaintenanceDaemon: %v", err)
+	}
+	admin, err := NewAdminServer("127.0.0.1:0", []string{"app"}, []*OverrideRollout{overrideRollout}, nil, []*MaintenanceDaemon{md})
+	if err != nil {
+		t.Fatalf("error starting admin server: %v", err)
+	}
+	return admin, overrideRollout, func() {
+		admin.Close()
+		md.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// newFormRequest creates a request with the given URL-encoded form as its body.
+func newFormRequest(method string, target string, form string) *http.Request {
+	request := httptest.NewRequest(method, target, strings.NewReader(form))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestAdminServerRollout(t *testing.T) {
+	admin, _, cleanup := newTestAdminServer(t, NewConstantRollout(0.25))
+	defer cleanup()
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("GET", "/rollout", nil))
+	var response rolloutResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("could not decode response %q: %v", recorder.Body.String(), err)
+	}
+	value := response.Values["canary"]
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected canary value 0.25, got %v", value)
+	}
+}
+
+func TestAdminServerOverride(t *testing.T) {
+	admin, rollout, cleanup := newTestAdminServer(t, NewConstantRollout(0.25))
+	defer cleanup()
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, newFormRequest("POST", "/override", "version=canary&value=0.75&ttl=1m"))
+	if recorder.Code != 200 {
+		t.Fatalf("unexpected status %v: %v", recorder.Code, recorder.Body.String())
+	}
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.75 {
+		t.Fatalf("expected overridden value 0.75, got %v", value)
+	}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("GET", "/override", nil))
+	var overrides map[string]Override
+	err := json.Unmarshal(recorder.Body.Bytes(), &overrides)
+	if err != nil || overrides["canary"].Percentage != 0.75 {
+		t.Fatalf("expected the canary override to be listed, got %q (%v)", recorder.Body.String(), err)
+	}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, newFormRequest("DELETE", "/override", "version=canary"))
+	value = rollout.Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected value 0.25 after clearing override, got %v", value)
+	}
+	for _, form := range []string{"version=canary&value=2&ttl=1m", "version=canary&value=0.5", "value=0.5&ttl=1m"} {
+		recorder = httptest.NewRecorder()
+		admin.ServeHTTP(recorder, newFormRequest("POST", "/override", form))
+		if recorder.Code != 400 {
+			t.Errorf("expected status 400 for %q, got %v", form, recorder.Code)
+		}
+	}
+	// the query string never changes state
+	for _, method := range []string{"GET", "POST"} {
+		recorder = httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(method, "/override?version=canary&value=0.75&ttl=1m", nil))
+		value = rollout.Get("canary")
+		if value == nil || *value != 0.25 {
+			t.Fatalf("expected a %v with a query string to leave 0.25, got %v", method, value)
+		}
+	}
+	if recorder.Code != 400 {
+		t.Errorf("expected status 400 for a POST without a form body, got %v", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, newFormRequest("PUT", "/override", "version=canary&value=0.75&ttl=1m"))
+	if recorder.Code != 405 {
+		t.Errorf("expected status 405 for a PUT, got %v", recorder.Code)
+	}
+}
+
+func TestAdminServerMaintenance(t *testing.T) {
+	admin, rollout, cleanup := newTestAdminServer(t, NewConstantRollout(0))
+	defer cleanup()
+	rollout.Override("maintenance", 1, time.Minute)
+	time.Sleep(1100 * time.Millisecond)
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("GET", "/maintenance", nil))
+	if recorder.Body.String() != "{\"on\":true}\n" {
+		t.Fatalf("unexpected maintenance response %q", recorder.Body.String())
+	}
+}
+
+func TestAdminServerGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	overrideRollout := NewOverrideRollout(NewConstantRollout(0.25))
+	guard, err := NewGuardedRollout(&NilMonitor{}, overrideRollout, staticHealthSource{
+		"master": {Requests: 1000, Errors: 1},
+		"canary": {Requests: 1000, Errors: 100},
+	}, time.Hour, 2, 100)
+	if err != nil {
+		t.Fatalf("error creating guard: %v", err)
+	}
+	defer guard.Stop()
+	md, err := NewMaintenanceDaemon(path.Join(dir, "test"), &NilMonitor{}, guard)
+	if err != nil {
+		t.Fatalf("Failed creating MaintenanceDaemon: %v", err)
+	}
+	defer md.Stop()
+	admin, err := NewAdminServer("127.0.0.1:0", []string{"app"}, []*OverrideRollout{overrideRollout}, []*GuardedRollout{guard}, []*MaintenanceDaemon{md})
+	if err != nil {
+		t.Fatalf("error starting admin server: %v", err)
+	}
+	defer admin.Close()
+	guard.check()
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("GET", "/rollout", nil))
+	var response rolloutResponse
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("could not decode response %q: %v", recorder.Body.String(), err)
+	}
+	value := response.Values["canary"]
+	if value == nil || *value != 0 {
+		t.Fatalf("expected rolled back canary value 0, got %v", value)
+	}
+	if _, ok := response.Tripped["canary"]; !ok {
+		t.Fatalf("expected canary to be listed as tripped, got %v", response.Tripped)
+	}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, newFormRequest("DELETE", "/guard", "version=canary"))
+	if recorder.Code != 200 || recorder.Body.String() != "{}\n" {
+		t.Fatalf("unexpected clear response %v %q", recorder.Code, recorder.Body.String())
+	}
+	value = guard.Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected canary value 0.25 after clearing, got %v", value)
+	}
+}
+
+func TestAdminServerApplications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	applications := []string{"website", "api"}
+	var overrides []*OverrideRollout
+	var maintenances []*MaintenanceDaemon
+	for i, name := range applications {
+		overrideRollout := NewOverrideRollout(NewConstantRollout(0.25 * float64(i+1)))
+		md, err := NewMaintenanceDaemon(path.Join(dir, name), &NilMonitor{}, overrideRollout)
+		if err != nil {
+			t.Fatalf("Failed creating MaintenanceDaemon: %v", err)
+		}
+		defer md.Stop()
+		overrides = append(overrides, overrideRollout)
+		maintenances = append(maintenances, md)
+	}
+	admin, err := NewAdminServer("127.0.0.1:0", applications, overrides, nil, maintenances)
+	if err != nil {
+		t.Fatalf("error starting admin server: %v", err)
+	}
+	defer admin.Close()
+	for target, expected := range map[string]float64{
+		"/rollout":                     0.25,
+		"/rollout?application=website": 0.25,
+		"/rollout?application=api":     0.5,
+	} {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		var response rolloutResponse
+		err := json.Unmarshal(recorder.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("could not decode response %q: %v", recorder.Body.String(), err)
+		}
+		value := response.Values["canary"]
+		if value == nil || *value != expected {
+			t.Fatalf("expected canary value %v from %v, got %v", expected, target, value)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, newFormRequest("POST", "/override?application=api", "version=canary&value=1&ttl=1m"))
+	if recorder.Code != 200 {
+		t.Fatalf("unexpected status %v: %v", recorder.Code, recorder.Body.String())
+	}
+	value := overrides[1].Get("canary")
+	if value == nil || *value != 1 {
+		t.Fatalf("expected the api canary to be overridden to 1, got %v", value)
+	}
+	value = overrides[0].Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected the website canary to be left at 0.25, got %v", value)
+	}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("GET", "/maintenance?application=admin", nil))
+	if recorder.Code != 404 {
+		t.Fatalf("expected status 404 for an unknown application, got %v", recorder.Code)
+	}
+}
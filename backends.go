@@ -0,0 +1,296 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// A backendConfig holds the settings shared by every backend.
+type backendConfig struct {
+	application string
+	delay       time.Duration
+	unhealthy   time.Duration
+	stateDir    string
+	// dogStatsDAddress is the address of the DogStatsD agent, which is
+	// set by options rather than the dogstatsd backend as it can be changed
+	// while the daemon runs
+	dogStatsDAddress string
+}
+
+// A rolloutCreator creates a rollout once flags have been parsed.
+type rolloutCreator func(Monitor, *backendConfig) (Rollout, error)
+
+// A monitorCreator creates a monitor once flags have been parsed.
+type monitorCreator func(*backendConfig) (Monitor, error)
+
+// A serverCreator creates a server once flags have been parsed.
+type serverCreator func(Monitor, Handler, *backendConfig) (Server, error)
+
+// A rolloutBackend defines its namespaced flags on the given flag set.
+type rolloutBackend func(*flag.FlagSet) rolloutCreator
+
+// A monitorBackend defines its namespaced flags on the given flag set.
+type monitorBackend func(*flag.FlagSet) monitorCreator
+
+// A serverBackend defines its namespaced flags on the given flag set.
+type serverBackend func(*flag.FlagSet) serverCreator
+
+// rolloutBackends holds every rollout selectable with the -rollout flag.
+var rolloutBackends = map[string]rolloutBackend{
+	"constant": func(fs *flag.FlagSet) rolloutCreator {
+		value := fs.Float64("constant.value", 0, "rollout value of the canary version")
+		return func(_ Monitor, _ *backendConfig) (Rollout, error) {
+			return NewConstantRollout(*value), nil
+		}
+	},
+	"dynamodb": func(fs *flag.FlagSet) rolloutCreator {
+		region := fs.String("dynamodb.region", "us-east-1", "AWS region for DynamoDB")
+		table := fs.String("dynamodb.table", "MaxwellsDaemon", "DynamoDB table used for rollout data")
+		defineDeprecated(fs, "region", "dynamodb.region")
+		defineDeprecated(fs, "table", "dynamodb.table")
+		// every application is polled by the same loop
+		var poller *DynamoDBPoller
+		return func(monitor Monitor, config *backendConfig) (Rollout, error) {
+			if poller == nil {
+				client := &http.Client{
+					Timeout: time.Second,
+				}
+				awsConfig := aws.NewConfig().WithRegion(*region).WithHTTPClient(client).WithMaxRetries(2)
+				db := dynamodb.New(session.New(), awsConfig)
+				var err error
+				poller, err = NewDynamoDBPoller(db, *table, config.delay)
+				if err != nil {
+					return nil, err
+				}
+			}
+			snapshot := path.Join(config.stateDir, "rollout", config.application+".json")
+			return poller.Add(monitor, config.application, config.unhealthy, snapshot), nil
+		}
+	},
+	"file": func(fs *flag.FlagSet) rolloutCreator {
+		filename := fs.String("file.path", "/etc/maxwells-daemon/rollout.json", "path to the JSON rollout file (\"{application}\" is replaced by the application name)")
+		return func(monitor Monitor, config *backendConfig) (Rollout, error) {
+			return NewFileRollout(monitor, strings.Replace(*filename, "{application}", config.application, -1), config.delay, config.unhealthy)
+		}
+	},
+	"httprollout": func(fs *flag.FlagSet) rolloutCreator {
+		url := fs.String("httprollout.url", "http://127.0.0.1:8080/rollout.json", "URL of the JSON rollout document, in the format of a rollout file (\"{application}\" is replaced by the application name)")
+		return func(monitor Monitor, config *backendConfig) (Rollout, error) {
+			return NewHTTPRollout(monitor, strings.Replace(*url, "{application}", config.application, -1), config.delay, config.unhealthy)
+		}
+	},
+}
+
+// monitorBackends holds every monitor selectable with the -monitor flag.
+var monitorBackends = map[string]monitorBackend{
+	"dogstatsd": func(fs *flag.FlagSet) monitorCreator {
+		namespace := fs.String("dogstatsd.namespace", "maxwellsdaemon", "namespace prefixed to every metric name (empty for none)")
+		tags := fs.String("dogstatsd.tags", "", "comma-separated tags added to every metric (e.g. \"env:production,host:web-1\")")
+		return func(config *backendConfig) (Monitor, error) {
+			var globalTags []string
+			for _, tag := range strings.Split(*tags, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					globalTags = append(globalTags, tag)
+				}
+			}
+			return NewDogStatsDMonitor(config.dogStatsDAddress, *namespace, globalTags)
+		}
+	},
+	"otlp": func(fs *flag.FlagSet) monitorCreator {
+		endpoint := fs.String("otlp.endpoint", "http://localhost:4318", "base URL of the OTLP/HTTP collector (spans are sent to /v1/traces and metrics to /v1/metrics)")
+		headers := fs.String("otlp.headers", "", "comma-separated <name>=<value> headers sent with every export (e.g. an API key)")
+		serviceName := fs.String("otlp.service-name", "maxwells-daemon", "service.name of exported spans and metrics")
+		sampleRatio := fs.Float64("otlp.sample-ratio", 0.01, "fraction of requests traced when the client gives no traceparent")
+		interval := fs.Duration("otlp.interval", 5*time.Second, "how often spans and metrics are exported")
+		return func(_ *backendConfig) (Monitor, error) {
+			parsed, err := parseOTLPHeaders(*headers)
+			if err != nil {
+				return nil, err
+			}
+			return NewOTLPMonitor(*endpoint, parsed, *serviceName, *sampleRatio, *interval)
+		}
+	},
+	"prometheus": func(fs *flag.FlagSet) monitorCreator {
+		address := fs.String("prometheus.address", ":9315", "listen address for the Prometheus /metrics endpoint")
+		return func(_ *backendConfig) (Monitor, error) {
+			return NewPrometheusMonitor(*address)
+		}
+	},
+	"nil": func(fs *flag.FlagSet) monitorCreator {
+		return func(_ *backendConfig) (Monitor, error) {
+			return &NilMonitor{}, nil
+		}
+	},
+}
+
+// serverBackends holds every server selectable with the -server flag.
+var serverBackends = map[string]serverBackend{
+	"http": func(fs *flag.FlagSet) serverCreator {
+		address := fs.String("http.address", "127.0.0.1:7374", "HTTP address to listen on")
+		assignmentHeader := fs.String("http.assignment-header", "maxwellsdaemon", "request header holding the assignment")
+		assignmentCookie := fs.String("http.assignment-cookie", "", "request cookie holding the assignment when the header is not set")
+		keyHeader := fs.String("http.key-header", "", "request header holding a stable key used when no assignment is set")
+		ipHeader := fs.String("http.ip-header", "X-Real-IP", "request header holding the end user's IP, matched by targeting rules (the last of a comma-separated list)")
+		pathHeader := fs.String("http.path-header", "X-Original-URI", "request header holding the original path, matched by targeting rules")
+		appHeader := fs.String("http.application-header", "X-Maxwell-Application", "request header naming the application (the first -application when missing)")
+		return func(monitor Monitor, handler Handler, _ *backendConfig) (Server, error) {
+			return NewHTTPServer(monitor, handler, *address, *assignmentHeader, *assignmentCookie, *keyHeader, *ipHeader, *pathHeader, *appHeader)
+		}
+	},
+	"tcp": func(fs *flag.FlagSet) serverCreator {
+		address := fs.String("tcp.address", "127.0.0.1:7373", "TCP address to listen on")
+		allow := fs.String("tcp.allow", "", "comma-separated CIDR networks allowed to connect (empty allows every client)")
+		idleTimeout := fs.Duration("tcp.idle-timeout", 0, "how long a connection may be idle between requests (0 allows a single request per connection)")
+		return func(monitor Monitor, handler Handler, _ *backendConfig) (Server, error) {
+			allowed, err := ParseNetworks(*allow)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse allowed networks: %v", err)
+			}
+			return NewTCPServer(monitor, handler, *address, allowed, *idleTimeout)
+		}
+	},
+	"unix": func(fs *flag.FlagSet) serverCreator {
+		socket := fs.String("unix.socket", "/tmp/maxwells-daemon.sock", "path to the unix socket file")
+		defineDeprecated(fs, "socket", "unix.socket")
+		idleTimeout := fs.Duration("unix.idle-timeout", 0, "how long a connection may be idle between requests (0 allows a single request per connection)")
+		mode := fs.String("unix.mode", "0666", "octal permissions of the unix socket file")
+		owner := fs.String("unix.owner", "", "user name or ID owning the unix socket file (empty keeps the daemon's user)")
+		group := fs.String("unix.group", "", "group name or ID of the unix socket file (empty keeps the daemon's group)")
+		return func(monitor Monitor, handler Handler, _ *backendConfig) (Server, error) {
+			perm, err := strconv.ParseUint(*mode, 8, 32)
+			if err != nil || perm > 0777 {
+				return nil, fmt.Errorf("invalid socket mode \"%v\"", *mode)
+			}
+			uid, err := lookupID(*owner, func(name string) (string, error) {
+				found, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return found.Uid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not find socket owner: %v", err)
+			}
+			gid, err := lookupID(*group, func(name string) (string, error) {
+				found, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return found.Gid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not find socket group: %v", err)
+			}
+			if !inherits("unix", *socket) {
+				err := removeStaleSocket(*socket)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return NewUnixServer(monitor, handler, *socket, os.FileMode(perm), uid, gid, *idleTimeout)
+		}
+	},
+}
+
+// A deprecatedFlag is the value of a flag kept under its name from before
+// backends were namespaced, which sets the flag that replaced it.
+type deprecatedFlag struct {
+	fs   *flag.FlagSet
+	name string
+}
+
+// String provides nothing, as the value is held by the replacing flag.
+func (deprecated *deprecatedFlag) String() string {
+	return ""
+}
+
+// Set sets the replacing flag.
+func (deprecated *deprecatedFlag) Set(value string) error {
+	return deprecated.fs.Set(deprecated.name, value)
+}
+
+// defineDeprecated defines the given old flag name on the given flag set as an
+// alias of the given (already defined) flag.
+func defineDeprecated(fs *flag.FlagSet, old string, name string) {
+	fs.Var(&deprecatedFlag{fs: fs, name: name}, old, fmt.Sprintf("deprecated: use -%v", name))
+}
+
+// dogStatsDAddress provides the address of the DogStatsD agent set by the
+// given -dogstatsd.address flag, or the -dogstatsd.port flag on localhost.
+func dogStatsDAddress(address *string, port *uint) string {
+	if *address != "" {
+		return *address
+	}
+	return fmt.Sprintf("127.0.0.1:%v", *port)
+}
+
+// lookupID converts the given user or group name, or numeric ID, to an ID
+// using the given lookup function.
+// An empty name gives -1, which leaves ownership unchanged.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// backendNames provides a readable, sorted list of the given backend names.
+func backendNames(names []string) string {
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// defineRollouts defines the flags of every rollout backend on the given flag
+// set and returns the flag selecting one of them along with their creators.
+func defineRollouts(fs *flag.FlagSet, defaultName string) (*string, map[string]rolloutCreator) {
+	var names []string
+	creators := make(map[string]rolloutCreator)
+	for name, backend := range rolloutBackends {
+		names = append(names, name)
+		creators[name] = backend(fs)
+	}
+	return fs.String("rollout", defaultName, fmt.Sprintf("rollout backend (%v)", backendNames(names))), creators
+}
+
+// defineMonitors defines the flags of every monitor backend on the given flag
+// set and returns the flag selecting one of them along with their creators.
+func defineMonitors(fs *flag.FlagSet, defaultName string) (*string, map[string]monitorCreator) {
+	var names []string
+	creators := make(map[string]monitorCreator)
+	for name, backend := range monitorBackends {
+		names = append(names, name)
+		creators[name] = backend(fs)
+	}
+	return fs.String("monitor", defaultName, fmt.Sprintf("comma-separated monitor backends, each receiving every metric (%v)", backendNames(names))), creators
+}
+
+// defineServers defines the flags of every server backend on the given flag
+// set and returns the flag selecting some of them along with their creators.
+func defineServers(fs *flag.FlagSet, defaultName string) (*string, map[string]serverCreator) {
+	var names []string
+	creators := make(map[string]serverCreator)
+	for name, backend := range serverBackends {
+		names = append(names, name)
+		creators[name] = backend(fs)
+	}
+	return fs.String("server", defaultName, fmt.Sprintf("comma-separated server backends to run together (%v)", backendNames(names))), creators
+}
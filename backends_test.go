@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestBackendSelection(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	rolloutName, rollouts := defineRollouts(fs, "dynamodb")
+	monitorName, monitors := defineMonitors(fs, "dogstatsd")
+	_, _ = defineServers(fs, "unix")
+	err := fs.Parse([]string{"-rollout", "constant", "-constant.value", "0.25", "-monitor", "nil"})
+	if err != nil {
+		t.Fatalf("error parsing flags: %v", err)
+	}
+	monitor, err := monitors[*monitorName](&backendConfig{})
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	rollout, err := rollouts[*rolloutName](monitor, &backendConfig{})
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected to read 0.25, read %v", value)
+	}
+}
+
+func TestDeprecatedFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	_, _ = defineRollouts(fs, "dynamodb")
+	_, _ = defineServers(fs, "unix")
+	err := fs.Parse([]string{"-socket", "/tmp/old.sock", "-table", "OldTable", "-region", "eu-west-1"})
+	if err != nil {
+		t.Fatalf("error parsing flags: %v", err)
+	}
+	for name, expected := range map[string]string{
+		"unix.socket":     "/tmp/old.sock",
+		"dynamodb.table":  "OldTable",
+		"dynamodb.region": "eu-west-1",
+	} {
+		value := fs.Lookup(name).Value.String()
+		if value != expected {
+			t.Fatalf("expected -%v to be set to %q by its old name, got %q", name, expected, value)
+		}
+	}
+}
+
+func TestUnixBackendPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "maxwells-daemon.sock")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	_, servers := defineServers(fs, "unix")
+	err = fs.Parse([]string{"-unix.socket", filename, "-unix.mode", "0660", "-unix.group", strconv.Itoa(os.Getgid())})
+	if err != nil {
+		t.Fatalf("error parsing flags: %v", err)
+	}
+	server, err := servers["unix"](&NilMonitor{}, &EchoHandler{}, &backendConfig{})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("Expected mode 0660, got %v (%v)", info.Mode().Perm(), err)
+	}
+	// a second daemon must not take over the live socket
+	_, err = servers["unix"](&NilMonitor{}, &EchoHandler{}, &backendConfig{})
+	if err == nil {
+		t.Fatalf("Expected an error while another server is listening")
+	}
+	server.Close()
+
+	err = fs.Set("unix.mode", "0999")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = servers["unix"](&NilMonitor{}, &EchoHandler{}, &backendConfig{})
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid mode")
+	}
+	fs.Set("unix.mode", "0600")
+	fs.Set("unix.group", "no-such-group-here")
+	_, err = servers["unix"](&NilMonitor{}, &EchoHandler{}, &backendConfig{})
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown group")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ParseConfig parses a configuration file in a small subset of TOML into flag
+// names and values.
+// Every line is blank, a comment ("# ..."), a table header ("[dynamodb]"), or
+// a "key = value" pair whose value is a double-quoted string, a number, or a
+// boolean; keys below a table header are prefixed with its name, e.g.
+//
+//	delay = "4s"
+//	[dynamodb]
+//	table = "MaxwellsDaemon"
+//
+// sets the flags "delay" and "dynamodb.table".
+func ParseConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %v: unterminated table header", number)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if table == "" {
+				return nil, fmt.Errorf("line %v: empty table header", number)
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %v: expected \"key = value\"", number)
+		}
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return nil, fmt.Errorf("line %v: empty key", number)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		value, err := parseConfigValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", number, err)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %v: \"%v\" is set twice", number, key)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	return values, nil
+}
+
+// parseConfigValue parses a single value, dropping any trailing comment.
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, "\"") {
+		end := 1
+		for ; end < len(raw); end++ {
+			if raw[end] == '\\' {
+				end++
+			} else if raw[end] == '"' {
+				break
+			}
+		}
+		if end >= len(raw) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		rest := strings.TrimSpace(raw[end+1:])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected text after string: %v", rest)
+		}
+		value, err := strconv.Unquote(raw[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("could not parse string: %v", err)
+		}
+		return value, nil
+	}
+	if comment := strings.Index(raw, "#"); comment >= 0 {
+		raw = strings.TrimSpace(raw[:comment])
+	}
+	if raw == "true" || raw == "false" {
+		return raw, nil
+	}
+	if _, err := strconv.ParseFloat(raw, 64); err != nil {
+		return "", fmt.Errorf("value %q is not a string, number, or boolean", raw)
+	}
+	return raw, nil
+}
+
+// applyConfigFile sets the flags named in the given configuration file,
+// except for flags that were set on the command line, which take precedence.
+func applyConfigFile(fs *flag.FlagSet, filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read config: %v", err)
+	}
+	values, err := ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("could not parse config: %v", err)
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range values {
+		if name == "config" {
+			return fmt.Errorf("config cannot name another config file")
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting \"%v\"", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		err := fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for \"%v\": %v", value, name, err)
+		}
+	}
+	return nil
+}
+
+// changedFlags provides the flags whose value differs between the two given
+// flag sets (which must define the same flags), mapped to their new value.
+func changedFlags(current *flag.FlagSet, reloaded *flag.FlagSet) map[string]string {
+	changed := make(map[string]string)
+	current.VisitAll(func(f *flag.Flag) {
+		value := reloaded.Lookup(f.Name).Value.String()
+		if value != f.Value.String() {
+			changed[f.Name] = value
+		}
+	})
+	return changed
+}
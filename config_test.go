@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	values, err := ParseConfig([]byte(`
+# maxwell's daemon
+application = "web,api" # the first is the default
+delay = "2s"
+guard.max-ratio = 1.5
+
+[dynamodb]
+table = "Rollouts \"b\""
+
+[ http ]
+address=":80"
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"application":     "web,api",
+		"delay":           "2s",
+		"guard.max-ratio": "1.5",
+		"dynamodb.table":  "Rollouts \"b\"",
+		"http.address":    ":80",
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, values)
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Fatalf("Expected %v to be %q, got %q", key, value, values[key])
+		}
+	}
+	for _, invalid := range []string{
+		"delay",
+		"= 1",
+		"delay = 2s",
+		"delay = \"2s",
+		"delay = \"2s\" 3",
+		"[dynamodb",
+		"[]",
+		"delay = 1\ndelay = 2",
+	} {
+		_, err := ParseConfig([]byte(invalid))
+		if err == nil {
+			t.Fatalf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "config.toml")
+	err = ioutil.WriteFile(filename, []byte("delay = \"2s\"\nunhealthy = \"1m\"\n[file]\npath = \"/tmp/rollout.json\"\n"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the command line takes precedence over the file
+	fs, opts, err := loadOptions("test", []string{"-config", filename, "-delay", "3s"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *opts.delay != 3*time.Second || *opts.unhealthy != time.Minute {
+		t.Fatalf("Expected 3s and 1m, got %v and %v", *opts.delay, *opts.unhealthy)
+	}
+	if fs.Lookup("file.path").Value.String() != "/tmp/rollout.json" {
+		t.Fatalf("Expected file.path to be set, got %v", fs.Lookup("file.path").Value)
+	}
+
+	for _, invalid := range []string{
+		"unknown = 1\n",
+		"config = \"/etc/other.toml\"\n",
+		"delay = \"soon\"\n",
+		"delay = \"-1s\"\n",
+		"rollout = \"carrier-pigeon\"\n",
+		"application = \"web,web\"\n",
+		"[guard]\nsource = \"/tmp/health.json\"\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(invalid), 0644)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, _, err = loadOptions("test", []string{"-config", filename}, flag.ContinueOnError)
+		if err == nil {
+			t.Fatalf("Expected error for %q", invalid)
+		}
+	}
+	_, _, err = loadOptions("test", []string{"-config", path.Join(dir, "missing.toml")}, flag.ContinueOnError)
+	if err == nil {
+		t.Fatalf("Expected error for a missing file")
+	}
+}
+
+func TestReloadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "rollout.json")
+	err = ioutil.WriteFile(filename, []byte(`{"canary": 0.5}`), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rollout, err := NewFileRollout(&NilMonitor{}, filename, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	guard, err := NewGuardedRollout(&NilMonitor{}, rollout, staticHealthSource{}, time.Hour, 2, 100)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer guard.Stop()
+	// the delay is kept short, as tuning applies it along with the unhealthy
+	// duration
+	current, opts, err := loadOptions("test", []string{"-delay", "1ms", "-unhealthy", "1h"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reloaded, _, err := loadOptions("test", []string{"-delay", "1ms", "-unhealthy", "16ms", "-guard.max-ratio", "3", "-logfile", "/tmp/other.log"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	changed := changedFlags(current, reloaded)
+	if len(changed) != 3 || changed["unhealthy"] != "16ms" {
+		t.Fatalf("Expected 3 changes, got %v", changed)
+	}
+
+	reloadOptions(current, opts, reloaded, []TunableRollout{rollout}, []*GuardedRollout{guard}, &NilMonitor{})
+	if *opts.unhealthy != 16*time.Millisecond || *opts.guardMaxRatio != 3 {
+		t.Fatalf("Expected live settings to change, got %v and %v", *opts.unhealthy, *opts.guardMaxRatio)
+	}
+	if *opts.logfile == "/tmp/other.log" {
+		t.Fatalf("Expected the log file not to change without a restart")
+	}
+	guard.mutex.RLock()
+	maxRatio := guard.maxRatio
+	guard.mutex.RUnlock()
+	if maxRatio != 3 {
+		t.Fatalf("Expected the guard's maximum ratio to be 3, got %v", maxRatio)
+	}
+	// the rollout goes stale under the new unhealthy duration once the file
+	// is gone
+	os.Remove(filename)
+	time.Sleep(64 * time.Millisecond)
+	if rollout.Get("canary") != nil {
+		t.Fatalf("Expected the rollout to go stale after tuning")
+	}
+}
+
+func TestReloadDogStatsDAddress(t *testing.T) {
+	current, opts, err := loadOptions("test", []string{"-dogstatsd.port", "8125"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	monitor, err := NewDogStatsDMonitor(dogStatsDAddress(opts.dogStatsDAddress, opts.dogStatsDPort), "maxwellsdaemon", nil)
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	defer monitor.Close()
+	reloaded, _, err := loadOptions("test", []string{"-dogstatsd.port", "8126"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reloadOptions(current, opts, reloaded, nil, nil, monitor)
+	monitor.client.mutex.Lock()
+	address := monitor.client.address
+	monitor.client.mutex.Unlock()
+	if *opts.dogStatsDPort != 8126 || address != "127.0.0.1:8126" {
+		t.Fatalf("Expected the monitor to move to port 8126, got %v (-dogstatsd.port %v)", address, *opts.dogStatsDPort)
+	}
+	// an address the monitor refuses leaves the setting as it was
+	reloaded, _, err = loadOptions("test", []string{"-dogstatsd.port", "8126", "-dogstatsd.address", "carrier-pigeon://loft"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reloadOptions(current, opts, reloaded, nil, nil, monitor)
+	if *opts.dogStatsDAddress != "" {
+		t.Fatalf("Expected the refused address not to be kept, got %v", *opts.dogStatsDAddress)
+	}
+	if _, _, err := loadOptions("test", []string{"-dogstatsd.port", "65536"}, flag.ContinueOnError); err == nil {
+		t.Fatalf("Expected an error for an out of range port")
+	}
+}
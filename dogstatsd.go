@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dogStatsDQueueSize is the number of metrics that may wait to be sent before
+// further metrics are dropped.
+const dogStatsDQueueSize int = 4096
+
+// unixPrefix marks a DogStatsD address that is the path of a Unix datagram
+// socket rather than a UDP address.
+const unixPrefix string = "unix://"
+
+// dogStatsDPacketSize is the largest datagram sent to DogStatsD; it fits in a
+// single Ethernet frame.
+const dogStatsDPacketSize int = 1432
+
+// dogStatsDFlushInterval is the longest a metric waits in a partially filled
+// datagram.
+const dogStatsDFlushInterval time.Duration = 100 * time.Millisecond
+
+// A dogStatsDClient represents a connection to a DogStatsD agent.
+// Metrics are queued without blocking and sent by a single goroutine, packed
+// into datagrams of up to dogStatsDPacketSize bytes that are sent once full or
+// after dogStatsDFlushInterval; metrics that do not fit in the queue are
+// dropped and counted.
+type dogStatsDClient struct {
+	network string
+	address string
+	prefix  string
+	tags    []string
+	conn    net.Conn
+	mutex   *sync.Mutex
+	queue   chan string
+	dropped uint64
+	ch      chan chan interface{}
+}
+
+func newDogStatsDClient(target string, prefix string, tags []string) (*dogStatsDClient, error) {
+	network, address, err := parseDogStatsDAddress(target)
+	if err != nil {
+		return nil, err
+	}
+	client := &dogStatsDClient{
+		network: network,
+		address: address,
+		prefix:  prefix,
+		tags:    tags,
+		mutex:   &sync.Mutex{},
+		queue:   make(chan string, dogStatsDQueueSize),
+		ch:      make(chan chan interface{}),
+	}
+	go client.run(client.ch)
+	return client, nil
+}
+
+// parseDogStatsDAddress provides the network and address of the given
+// DogStatsD address, either "<host>:<port>" (UDP) or "unix://<path>" (a Unix
+// datagram socket).
+func parseDogStatsDAddress(target string) (string, string, error) {
+	if strings.HasPrefix(target, unixPrefix) {
+		path := target[len(unixPrefix):]
+		if path == "" {
+			return "", "", fmt.Errorf("socket path of \"%v\" is empty", target)
+		}
+		return "unixgram", path, nil
+	}
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse DogStatsD address \"%v\": %v", target, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("port of \"%v\" is out of range", target)
+	}
+	return "udp", target, nil
+}
+
+// send queues the given newline-terminated metric, dropping it if the queue
+// is full.
+func (client *dogStatsDClient) send(s string) {
+	select {
+	case client.queue <- s:
+	default:
+		atomic.AddUint64(&client.dropped, 1)
+	}
+}
+
+// Dropped provides the number of metrics dropped because the queue was full.
+func (client *dogStatsDClient) Dropped() uint64 {
+	return atomic.LoadUint64(&client.dropped)
+}
+
+// run packs queued metrics into datagrams until the client is closed through
+// the given channel.
+func (client *dogStatsDClient) run(ch chan chan interface{}) {
+	tick := time.NewTicker(dogStatsDFlushInterval)
+	defer tick.Stop()
+	packet := make([]byte, 0, dogStatsDPacketSize)
+	add := func(s string) {
+		if len(packet)+len(s) > dogStatsDPacketSize && len(packet) > 0 {
+			client.write(packet)
+			packet = packet[:0]
+		}
+		packet = append(packet, s...)
+	}
+	flush := func() {
+		if len(packet) > 0 {
+			client.write(packet)
+			packet = packet[:0]
+		}
+	}
+	var reported uint64
+	for {
+		select {
+		case s := <-client.queue:
+			add(s)
+		case <-tick.C:
+			if dropped := client.Dropped(); dropped > reported {
+				line := fmt.Sprintf("%vmonitor.dropped:%v|c", client.prefix, dropped-reported)
+				if len(client.tags) > 0 {
+					line += "|#" + strings.Join(client.tags, ",")
+				}
+				add(line + "\n")
+				reported = dropped
+			}
+			flush()
+		case done := <-ch:
+			for len(client.queue) > 0 {
+				add(<-client.queue)
+			}
+			flush()
+			client.mutex.Lock()
+			if client.conn != nil {
+				_ = client.conn.Close()
+				client.conn = nil
+			}
+			client.mutex.Unlock()
+			close(done)
+			return
+		}
+	}
+}
+
+// write sends a single datagram, connecting first if needed.
+func (client *dogStatsDClient) write(packet []byte) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.conn == nil {
+		conn, err := net.Dial(client.network, client.address)
+		if err != nil {
+			log.Printf("monitor: could not connect to DogStatsD: %v\n", err)
+			return
+		}
+		client.conn = conn
+	}
+	written, err := client.conn.Write(packet)
+	if err != nil || written != len(packet) {
+		log.Printf("monitor: error writing data to DogStatsD: %v\n", err)
+		_ = client.conn.Close()
+		client.conn = nil
+		return
+	}
+}
+
+// close sends every queued metric and stops the client.
+func (client *dogStatsDClient) close() error {
+	client.mutex.Lock()
+	ch := client.ch
+	client.ch = nil
+	client.mutex.Unlock()
+	if ch == nil {
+		return fmt.Errorf("already closed")
+	}
+	done := make(chan interface{})
+	ch <- done
+	<-done
+	return nil
+}
+
+// A DogStatsDMonitor represents a proxy for sending metrics to Datadog, named
+// within a namespace (e.g. "maxwellsdaemon.server.success").
+type DogStatsDMonitor struct {
+	client *dogStatsDClient
+	tags   []string
+}
+
+// NewDogStatsDMonitor creates a connection to the DogStatsD agent at the
+// given address, "<host>:<port>" (UDP) or "unix://<path>" (a Unix datagram
+// socket), and prepares to accept metrics.
+// Every metric is named within the given namespace (unless it is empty) and
+// carries the given tags, e.g. "env:production".
+func NewDogStatsDMonitor(address string, namespace string, tags []string) (*DogStatsDMonitor, error) {
+	prefix := ""
+	if namespace != "" {
+		prefix = namespace + "."
+	}
+	client, err := newDogStatsDClient(address, prefix, tags)
+	if err != nil {
+		return nil, err
+	}
+	return &DogStatsDMonitor{
+		client: client,
+		tags:   tags,
+	}, nil
+}
+
+// Close sends every metric still queued and stops sending metrics (for every
+// monitor sharing the connection).
+func (statsdMonitor *DogStatsDMonitor) Close() error {
+	return statsdMonitor.client.close()
+}
+
+// SetAddress sends every metric from now on to the DogStatsD agent at the
+// given address (for every monitor sharing the connection).
+func (statsdMonitor *DogStatsDMonitor) SetAddress(target string) error {
+	network, address, err := parseDogStatsDAddress(target)
+	if err != nil {
+		return err
+	}
+	client := statsdMonitor.client
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.network == network && client.address == address {
+		return nil
+	}
+	client.network = network
+	client.address = address
+	if client.conn != nil {
+		_ = client.conn.Close()
+		client.conn = nil
+	}
+	return nil
+}
+
+// ForApplication provides a monitor that sends through the same connection,
+// adding the tag "application:<name>" to every metric.
+func (statsdMonitor *DogStatsDMonitor) ForApplication(application string) Monitor {
+	tags := append([]string(nil), statsdMonitor.tags...)
+	return &DogStatsDMonitor{
+		client: statsdMonitor.client,
+		tags:   append(tags, "application:"+application),
+	}
+}
+
+// send sends a single metric of the given type along with the monitor's tags
+// and the given tags.
+func (statsdMonitor *DogStatsDMonitor) send(name string, value interface{}, kind string, tags ...string) {
+	line := fmt.Sprintf("%v%v:%v|%v", statsdMonitor.client.prefix, name, value, kind)
+	tags = append(append([]string(nil), statsdMonitor.tags...), tags...)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	statsdMonitor.client.send(line + "\n")
+}
+
+// sendEvent sends a single event along with the monitor's tags and the given
+// tags.
+func (statsdMonitor *DogStatsDMonitor) sendEvent(title string, text string, alertType string, tags ...string) {
+	line := fmt.Sprintf("_e{%v,%v}:%v|%v|t:%v", len(title), len(text), title, text, alertType)
+	tags = append(append([]string(nil), statsdMonitor.tags...), tags...)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	statsdMonitor.client.send(line + "\n")
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordServe(err error) {
+	if err != nil {
+		statsdMonitor.send("server.success", 0, "c")
+		statsdMonitor.send("server.failure", 1, "c")
+	} else {
+		statsdMonitor.send("server.success", 1, "c")
+		statsdMonitor.send("server.failure", 0, "c")
+	}
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordServingTime(duration time.Duration) {
+	milliseconds := duration / time.Millisecond
+	statsdMonitor.send("server.delay", int64(milliseconds), "h")
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordHandling(location string, err error) {
+	if err != nil {
+		statsdMonitor.send("handler.success", 0, "c")
+		statsdMonitor.send("handler.failure", 1, "c")
+	} else {
+		statsdMonitor.send("handler.success", 1, "c", "location:"+location)
+		statsdMonitor.send("handler.failure", 0, "c")
+	}
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordRolloutUpdate(err error) {
+	if err != nil {
+		statsdMonitor.send("rollout.update.success", 0, "c")
+		statsdMonitor.send("rollout.update.failure", 1, "c")
+	} else {
+		statsdMonitor.send("rollout.update.success", 1, "c")
+		statsdMonitor.send("rollout.update.failure", 0, "c")
+	}
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordRollback(version string, reason string) {
+	text := fmt.Sprintf("rolled back \"%v\": %v", version, reason)
+	statsdMonitor.send("guard.rollback", 1, "c", "version:"+version)
+	statsdMonitor.sendEvent("maxwellsdaemon rollback", text, "error", "version:"+version)
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordRolloutValue(version string, value float64) {
+	statsdMonitor.send("rollout.value", value, "g", "version:"+version)
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordStaleness(version string, staleness time.Duration) {
+	statsdMonitor.send("rollout.staleness", staleness.Seconds(), "g", "version:"+version)
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordUnhealthy(version string, unhealthy bool) {
+	if unhealthy {
+		text := fmt.Sprintf("\"%v\" went stale and is served at 0", version)
+		statsdMonitor.send("rollout.unhealthy", 1, "c", "version:"+version)
+		statsdMonitor.sendEvent("maxwellsdaemon unhealthy", text, "warning", "version:"+version)
+	} else {
+		text := fmt.Sprintf("\"%v\" is being read again", version)
+		statsdMonitor.send("rollout.recovered", 1, "c", "version:"+version)
+		statsdMonitor.sendEvent("maxwellsdaemon recovered", text, "success", "version:"+version)
+	}
+}
+
+func (statsdMonitor *DogStatsDMonitor) RecordMaintenance(on bool) {
+	if on {
+		statsdMonitor.send("maintenance", 1, "g")
+		statsdMonitor.sendEvent("maxwellsdaemon maintenance", "maintenance mode turned on", "warning")
+	} else {
+		statsdMonitor.send("maintenance", 0, "g")
+		statsdMonitor.sendEvent("maxwellsdaemon maintenance", "maintenance mode turned off", "success")
+	}
+}
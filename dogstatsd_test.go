@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDogStatsDMonitor(t *testing.T, port int, tags []string) *DogStatsDMonitor {
+	monitor, err := NewDogStatsDMonitor(fmt.Sprintf("127.0.0.1:%v", port), "maxwellsdaemon", tags)
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	return monitor
+}
+
+func TestDogStatsDMonitorApplication(t *testing.T) {
+	connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening for metrics: %v", err)
+	}
+	defer connection.Close()
+	port := connection.LocalAddr().(*net.UDPAddr).Port
+	monitor := newTestDogStatsDMonitor(t, port, nil).ForApplication("website")
+	monitor.RecordHandling("canary", nil)
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 1024)
+	count, _, err := connection.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	expected := "maxwellsdaemon.handler.success:1|c|#application:website,location:canary\n"
+	if !strings.HasPrefix(string(buffer[:count]), expected) {
+		t.Fatalf("expected metric %q, got %q", expected, buffer[:count])
+	}
+}
+
+func TestDogStatsDMonitorBatching(t *testing.T) {
+	connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening for metrics: %v", err)
+	}
+	defer connection.Close()
+	port := connection.LocalAddr().(*net.UDPAddr).Port
+	monitor := newTestDogStatsDMonitor(t, port, nil)
+	for i := 0; i < 100; i++ {
+		monitor.RecordServe(nil)
+	}
+	err = monitor.Close()
+	if err != nil {
+		t.Fatalf("error closing monitor: %v", err)
+	}
+	if monitor.Close() == nil {
+		t.Fatalf("monitor was able to be doubly-closed")
+	}
+	// 200 metrics are packed into a few datagrams, none over the size limit
+	metrics := 0
+	packets := 0
+	buffer := make([]byte, 65536)
+	for metrics < 200 {
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		count, _, err := connection.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("error reading metrics after %v: %v", metrics, err)
+		}
+		if count > dogStatsDPacketSize {
+			t.Fatalf("expected at most %v bytes, got %v", dogStatsDPacketSize, count)
+		}
+		packets++
+		metrics += strings.Count(string(buffer[:count]), "\n")
+	}
+	if packets >= 20 {
+		t.Fatalf("expected metrics to be batched, got %v datagrams", packets)
+	}
+}
+
+func TestDogStatsDMonitorRolloutState(t *testing.T) {
+	connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening for metrics: %v", err)
+	}
+	defer connection.Close()
+	port := connection.LocalAddr().(*net.UDPAddr).Port
+	monitor := newTestDogStatsDMonitor(t, port, nil)
+	monitor.RecordRolloutValue("canary", 0.25)
+	monitor.RecordStaleness("canary", 1500*time.Millisecond)
+	monitor.RecordUnhealthy("canary", true)
+	monitor.RecordMaintenance(true)
+	monitor.Close()
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 65536)
+	count, _, err := connection.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	expected := []string{
+		"maxwellsdaemon.rollout.value:0.25|g|#version:canary\n",
+		"maxwellsdaemon.rollout.staleness:1.5|g|#version:canary\n",
+		"maxwellsdaemon.rollout.unhealthy:1|c|#version:canary\n",
+		"_e{24,38}:maxwellsdaemon unhealthy|\"canary\" went stale and is served at 0|t:warning|#version:canary\n",
+		"maxwellsdaemon.maintenance:1|g\n",
+		"_e{26,26}:maxwellsdaemon maintenance|maintenance mode turned on|t:warning\n",
+	}
+	if string(buffer[:count]) != strings.Join(expected, "") {
+		t.Fatalf("expected metrics %q, got %q", strings.Join(expected, ""), buffer[:count])
+	}
+}
+
+func TestDogStatsDClientDrops(t *testing.T) {
+	// a client whose queue is not being drained
+	client := &dogStatsDClient{
+		queue: make(chan string, 2),
+	}
+	for i := 0; i < 5; i++ {
+		client.send("maxwellsdaemon.server.success:1|c\n")
+	}
+	if client.Dropped() != 3 {
+		t.Fatalf("expected 3 dropped metrics, got %v", client.Dropped())
+	}
+}
+
+func TestDogStatsDMonitorUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "dsd.socket")
+	connection, err := net.ListenPacket("unixgram", filename)
+	if err != nil {
+		t.Fatalf("error listening for metrics: %v", err)
+	}
+	defer connection.Close()
+	monitor, err := NewDogStatsDMonitor("unix://"+filename, "canary", []string{"env:test", "host:web-1"})
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	monitor.RecordRolloutUpdate(nil)
+	monitor.Close()
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 1024)
+	count, _, err := connection.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	expected := "canary.rollout.update.success:1|c|#env:test,host:web-1\n"
+	if !strings.HasPrefix(string(buffer[:count]), expected) {
+		t.Fatalf("expected metric %q, got %q", expected, buffer[:count])
+	}
+}
+
+func TestParseDogStatsDAddress(t *testing.T) {
+	valid := map[string][2]string{
+		"127.0.0.1:8125":                     {"udp", "127.0.0.1:8125"},
+		"datadog-agent:8125":                 {"udp", "datadog-agent:8125"},
+		"unix:///var/run/datadog/dsd.socket": {"unixgram", "/var/run/datadog/dsd.socket"},
+	}
+	for target, expected := range valid {
+		network, address, err := parseDogStatsDAddress(target)
+		if err != nil || network != expected[0] || address != expected[1] {
+			t.Fatalf("expected %v for %q, got %v %v (%v)", expected, target, network, address, err)
+		}
+	}
+	for _, target := range []string{"", "8125", "localhost:99999", "unix://"} {
+		_, _, err := parseDogStatsDAddress(target)
+		if err == nil {
+			t.Fatalf("expected error for %q", target)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fanoutQueueSize is the number of records that may wait for a single monitor
+// of a FanoutMonitor before further records for it are dropped.
+const fanoutQueueSize int = 4096
+
+// A fanoutWorker represents the goroutine recording to a single monitor of a
+// FanoutMonitor.
+type fanoutWorker struct {
+	queue   chan func()
+	dropped uint64
+	done    chan interface{}
+}
+
+func newFanoutWorker() *fanoutWorker {
+	worker := &fanoutWorker{
+		queue: make(chan func(), fanoutQueueSize),
+		done:  make(chan interface{}),
+	}
+	go worker.run()
+	return worker
+}
+
+// run records until the queue is closed.
+func (worker *fanoutWorker) run() {
+	defer close(worker.done)
+	for record := range worker.queue {
+		safely(record)
+	}
+}
+
+// safely calls the given function, recovering (and logging) any panic.
+func safely(record func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("monitor: recovered from panic: %v\n", recovered)
+		}
+	}()
+	record()
+}
+
+// do queues the given record, dropping it if the queue is full.
+func (worker *fanoutWorker) do(record func()) {
+	select {
+	case worker.queue <- record:
+	default:
+		atomic.AddUint64(&worker.dropped, 1)
+	}
+}
+
+// A fanoutGroup holds the goroutines of a FanoutMonitor, shared with the
+// monitors it provides for each application.
+type fanoutGroup struct {
+	workers []*fanoutWorker
+	mutex   *sync.RWMutex
+	closed  bool
+}
+
+// A FanoutMonitor represents a monitor that records everything to each of
+// several monitors, e.g. to send identical data to DogStatsD and Prometheus.
+// Every monitor is recorded to by its own goroutine through a bounded queue,
+// so a slow monitor cannot delay serving (its records are dropped once its
+// queue fills up) and a panicking monitor is recovered from.
+type FanoutMonitor struct {
+	monitors []Monitor
+	group    *fanoutGroup
+	root     bool
+}
+
+// NewFanoutMonitor creates a monitor recording to each of the given monitors.
+func NewFanoutMonitor(monitors ...Monitor) *FanoutMonitor {
+	group := &fanoutGroup{
+		mutex: &sync.RWMutex{},
+	}
+	for range monitors {
+		group.workers = append(group.workers, newFanoutWorker())
+	}
+	return &FanoutMonitor{
+		monitors: monitors,
+		group:    group,
+		root:     true,
+	}
+}
+
+// Monitors provides the monitors recorded to.
+func (fanoutMonitor *FanoutMonitor) Monitors() []Monitor {
+	return append([]Monitor(nil), fanoutMonitor.monitors...)
+}
+
+// Dropped provides the number of records dropped for each monitor because
+// its queue was full.
+func (fanoutMonitor *FanoutMonitor) Dropped() []uint64 {
+	dropped := make([]uint64, len(fanoutMonitor.group.workers))
+	for i, worker := range fanoutMonitor.group.workers {
+		dropped[i] = atomic.LoadUint64(&worker.dropped)
+	}
+	return dropped
+}
+
+// ForApplication provides a monitor that records through the same goroutines
+// to each monitor's view of the given application (see ApplicationMonitor).
+func (fanoutMonitor *FanoutMonitor) ForApplication(application string) Monitor {
+	monitors := make([]Monitor, len(fanoutMonitor.monitors))
+	for i, monitor := range fanoutMonitor.monitors {
+		monitors[i] = monitorForApplication(monitor, application)
+	}
+	return &FanoutMonitor{
+		monitors: monitors,
+		group:    fanoutMonitor.group,
+	}
+}
+
+// ObserveRollout passes the given rollout to every monitor that observes
+// rollouts (see RolloutObserver).
+func (fanoutMonitor *FanoutMonitor) ObserveRollout(rollout Rollout) {
+	for _, monitor := range fanoutMonitor.monitors {
+		if observer, ok := monitor.(RolloutObserver); ok {
+			safely(func() {
+				observer.ObserveRollout(rollout)
+			})
+		}
+	}
+}
+
+// TraceRequest queues the given trace for every monitor that traces requests
+// (see RequestTracer).
+func (fanoutMonitor *FanoutMonitor) TraceRequest(trace *RequestTrace) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		if tracer, ok := monitor.(RequestTracer); ok {
+			tracer.TraceRequest(trace)
+		}
+	})
+}
+
+// Close records everything still queued, stops every goroutine, and closes
+// every monitor that can be closed, returning the first error encountered.
+// Only the monitor created by NewFanoutMonitor can be closed.
+func (fanoutMonitor *FanoutMonitor) Close() error {
+	if !fanoutMonitor.root {
+		return fmt.Errorf("cannot close an application's monitor")
+	}
+	group := fanoutMonitor.group
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if group.closed {
+		return fmt.Errorf("already closed")
+	}
+	group.closed = true
+	for _, worker := range group.workers {
+		close(worker.queue)
+	}
+	var result error
+	for i, worker := range group.workers {
+		<-worker.done
+		if closer, ok := fanoutMonitor.monitors[i].(io.Closer); ok {
+			err := closer.Close()
+			if err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+// each queues the given record for every monitor.
+func (fanoutMonitor *FanoutMonitor) each(record func(Monitor)) {
+	group := fanoutMonitor.group
+	group.mutex.RLock()
+	defer group.mutex.RUnlock()
+	if group.closed {
+		return
+	}
+	for i, worker := range group.workers {
+		monitor := fanoutMonitor.monitors[i]
+		worker.do(func() {
+			record(monitor)
+		})
+	}
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordServe(err error) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordServe(err)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordServingTime(duration time.Duration) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordServingTime(duration)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordHandling(location string, err error) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordHandling(location, err)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordRolloutUpdate(err error) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordRolloutUpdate(err)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordRollback(version string, reason string) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordRollback(version, reason)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordRolloutValue(version string, value float64) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordRolloutValue(version, value)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordStaleness(version string, staleness time.Duration) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordStaleness(version, staleness)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordUnhealthy(version string, unhealthy bool) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordUnhealthy(version, unhealthy)
+	})
+}
+
+func (fanoutMonitor *FanoutMonitor) RecordMaintenance(on bool) {
+	fanoutMonitor.each(func(monitor Monitor) {
+		monitor.RecordMaintenance(on)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A countingMonitor counts the handlings it records, by application.
+type countingMonitor struct {
+	NilMonitor
+	application string
+	mutex       *sync.Mutex
+	handlings   map[string]int
+}
+
+func newCountingMonitor() *countingMonitor {
+	return &countingMonitor{
+		mutex:     &sync.Mutex{},
+		handlings: make(map[string]int),
+	}
+}
+
+func (monitor *countingMonitor) ForApplication(application string) Monitor {
+	return &countingMonitor{
+		application: application,
+		mutex:       monitor.mutex,
+		handlings:   monitor.handlings,
+	}
+}
+
+func (monitor *countingMonitor) RecordHandling(_ string, _ error) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.handlings[monitor.application]++
+}
+
+func (monitor *countingMonitor) count(application string) int {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.handlings[application]
+}
+
+// A panickingMonitor panics on every handling.
+type panickingMonitor struct {
+	NilMonitor
+}
+
+func (monitor *panickingMonitor) RecordHandling(_ string, _ error) {
+	panic("broken monitor")
+}
+
+// A blockingMonitor blocks every handling until released.
+type blockingMonitor struct {
+	NilMonitor
+	release chan interface{}
+}
+
+func (monitor *blockingMonitor) RecordHandling(_ string, _ error) {
+	<-monitor.release
+}
+
+func TestFanoutMonitor(t *testing.T) {
+	counting := newCountingMonitor()
+	blocking := &blockingMonitor{release: make(chan interface{})}
+	monitor := NewFanoutMonitor(counting, &panickingMonitor{}, blocking)
+	application := monitor.ForApplication("website")
+
+	// recording never waits for the blocked monitor
+	start := time.Now()
+	total := fanoutQueueSize + 100
+	for i := 0; i < total; i++ {
+		application.RecordHandling("canary", nil)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("recording was delayed by a blocked monitor: %v", time.Since(start))
+	}
+	close(blocking.release)
+	err := monitor.Close()
+	if err != nil {
+		t.Fatalf("error closing monitor: %v", err)
+	}
+	if monitor.Close() == nil {
+		t.Fatalf("monitor was able to be doubly-closed")
+	}
+	if application.(*FanoutMonitor).Close() == nil {
+		t.Fatalf("an application's monitor was able to be closed")
+	}
+
+	// every handling is either recorded or counted as dropped
+	dropped := monitor.Dropped()
+	if counting.count("website")+int(dropped[0]) != total {
+		t.Fatalf("expected %v handlings, got %v (%v dropped)", total, counting.count("website"), dropped[0])
+	}
+	if counting.count("website") < fanoutQueueSize || dropped[2] == 0 {
+		t.Fatalf("expected drops for the blocked monitor, got %v", dropped)
+	}
+	// records after closing are ignored
+	application.RecordHandling("canary", nil)
+}
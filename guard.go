@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthSource is an interface implemented by a value that can provide recent
+// request and error counts for each version.
+type HealthSource interface {
+	// Health provides the counts of every version, keyed by version name
+	// (including "master").
+	Health() (map[string]VersionHealth, error)
+}
+
+// A VersionHealth holds the request and error counts of a single version over
+// a recent window.
+type VersionHealth struct {
+	Requests float64 `json:"requests"`
+	Errors   float64 `json:"errors"`
+}
+
+func parseHealth(data []byte) (map[string]VersionHealth, error) {
+	var health map[string]VersionHealth
+	err := json.Unmarshal(data, &health)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse health data: %v", err)
+	}
+	return health, nil
+}
+
+// A FileHealthSource represents health data written to a local JSON file (e.g.
+// by the proxy), holding an object that maps version names to counts:
+// {"master": {"requests": 1000, "errors": 2}, "canary": {"requests": 40, "errors": 9}}.
+type FileHealthSource struct {
+	filename string
+}
+
+// NewFileHealthSource creates a health source that reads the given file.
+func NewFileHealthSource(filename string) *FileHealthSource {
+	return &FileHealthSource{
+		filename: filename,
+	}
+}
+
+// Health provides the counts currently stored in the file.
+func (fileHealthSource *FileHealthSource) Health() (map[string]VersionHealth, error) {
+	data, err := ioutil.ReadFile(fileHealthSource.filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read health file: %v", err)
+	}
+	return parseHealth(data)
+}
+
+// An HTTPHealthSource represents health data served by a local metrics
+// endpoint in the same JSON format as a FileHealthSource.
+type HTTPHealthSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPHealthSource creates a health source that requests the given URL.
+func NewHTTPHealthSource(url string) *HTTPHealthSource {
+	return &HTTPHealthSource{
+		url: url,
+		client: &http.Client{
+			Timeout: time.Second,
+		},
+	}
+}
+
+// Health provides the counts currently served by the endpoint.
+func (httpHealthSource *HTTPHealthSource) Health() (map[string]VersionHealth, error) {
+	response, err := httpHealthSource.client.Get(httpHealthSource.url)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch health data: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch health data: status %v", response.StatusCode)
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read health data: %v", err)
+	}
+	return parseHealth(data)
+}
+
+// A GuardedRollout represents a rollout that provides the values of another
+// rollout, but forces a version to 0 on this host once its error rate exceeds
+// master's by too much.
+// A forced version stays at 0 until an operator clears it (or the daemon
+// restarts).
+type GuardedRollout struct {
+	rollout     Rollout
+	monitor     Monitor
+	source      HealthSource
+	maxRatio    float64
+	minRequests float64
+	mutex       *sync.RWMutex
+	tripped     map[string]string
+	changes     uint64
+	ch          chan interface{}
+}
+
+// minimumErrorRate is the error rate master is assumed to have at least, so
+// that a flawless master does not trip the guard on a single canary error.
+const minimumErrorRate float64 = 0.001
+
+// NewGuardedRollout creates a rollout that checks the given health source
+// with the given interval.
+// A version is forced to 0 once it has served at least minRequests requests
+// and its error rate is more than maxRatio times master's.
+func NewGuardedRollout(monitor Monitor, rollout Rollout, source HealthSource, interval time.Duration, maxRatio float64, minRequests float64) (*GuardedRollout, error) {
+	if maxRatio <= 0 {
+		return nil, fmt.Errorf("maximum error ratio must be positive")
+	}
+	guardedRollout := &GuardedRollout{
+		rollout:     rollout,
+		monitor:     monitor,
+		source:      source,
+		maxRatio:    maxRatio,
+		minRequests: minRequests,
+		mutex:       &sync.RWMutex{},
+		tripped:     make(map[string]string),
+		ch:          make(chan interface{}),
+	}
+	ch := guardedRollout.ch
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ch:
+				return
+			case <-tick.C:
+				guardedRollout.check()
+			}
+		}
+	}()
+	return guardedRollout, nil
+}
+
+func errorRate(health VersionHealth) float64 {
+	if health.Requests <= 0 {
+		return 0
+	}
+	return health.Errors / health.Requests
+}
+
+// check compares the error rate of every version to master's, forcing
+// versions that breach the threshold to 0.
+func (guardedRollout *GuardedRollout) check() {
+	health, err := guardedRollout.source.Health()
+	if err != nil {
+		log.Printf("guard: %v\n", err)
+		return
+	}
+	guardedRollout.mutex.RLock()
+	maxRatio := guardedRollout.maxRatio
+	minRequests := guardedRollout.minRequests
+	guardedRollout.mutex.RUnlock()
+	masterRate := errorRate(health["master"])
+	if masterRate < minimumErrorRate {
+		masterRate = minimumErrorRate
+	}
+	for name, versionHealth := range health {
+		if reservedVersions[name] || versionHealth.Requests < minRequests {
+			continue
+		}
+		rate := errorRate(versionHealth)
+		if rate <= masterRate*maxRatio {
+			continue
+		}
+		reason := fmt.Sprintf("error rate %.4f is %.1f times master's %.4f over %v requests", rate, rate/masterRate, masterRate, versionHealth.Requests)
+		guardedRollout.mutex.Lock()
+		_, ok := guardedRollout.tripped[name]
+		if !ok {
+			guardedRollout.tripped[name] = reason
+			guardedRollout.changes++
+		}
+		guardedRollout.mutex.Unlock()
+		if !ok {
+			log.Printf("guard: rolling back \"%v\": %v\n", name, reason)
+			guardedRollout.monitor.RecordRollback(name, reason)
+		}
+	}
+}
+
+// SetThresholds replaces the thresholds given to NewGuardedRollout, from the
+// next check on.
+// Versions that have already been forced to 0 remain so.
+func (guardedRollout *GuardedRollout) SetThresholds(maxRatio float64, minRequests float64) error {
+	if maxRatio <= 0 {
+		return fmt.Errorf("maximum error ratio must be positive")
+	}
+	guardedRollout.mutex.Lock()
+	defer guardedRollout.mutex.Unlock()
+	guardedRollout.maxRatio = maxRatio
+	guardedRollout.minRequests = minRequests
+	return nil
+}
+
+// Stop stops checking the health source forever.
+// Versions that have been forced to 0 remain so.
+func (guardedRollout *GuardedRollout) Stop() {
+	guardedRollout.mutex.Lock()
+	defer guardedRollout.mutex.Unlock()
+	if guardedRollout.ch != nil {
+		close(guardedRollout.ch)
+		guardedRollout.ch = nil
+	}
+}
+
+// Tripped provides every version forced to 0, along with the reason.
+func (guardedRollout *GuardedRollout) Tripped() map[string]string {
+	guardedRollout.mutex.RLock()
+	defer guardedRollout.mutex.RUnlock()
+	tripped := make(map[string]string, len(guardedRollout.tripped))
+	for name, reason := range guardedRollout.tripped {
+		tripped[name] = reason
+	}
+	return tripped
+}
+
+// Clear allows the given version to follow the underlying rollout again.
+func (guardedRollout *GuardedRollout) Clear(name string) {
+	guardedRollout.mutex.Lock()
+	if _, ok := guardedRollout.tripped[name]; ok {
+		delete(guardedRollout.tripped, name)
+		guardedRollout.changes++
+	}
+	guardedRollout.mutex.Unlock()
+	log.Printf("guard: \"%v\" cleared\n", name)
+}
+
+// Get provides 0 for a version that has been forced to 0, otherwise the value
+// of the underlying rollout.
+// The return value may be outside of the [0.0,1.0] range.
+func (guardedRollout *GuardedRollout) Get(name string) *float64 {
+	guardedRollout.mutex.RLock()
+	_, ok := guardedRollout.tripped[name]
+	guardedRollout.mutex.RUnlock()
+	if ok {
+		zero := 0.0
+		return &zero
+	}
+	return guardedRollout.rollout.Get(name)
+}
+
+// Versions provides the versions of the underlying rollout.
+func (guardedRollout *GuardedRollout) Versions() []string {
+	return guardedRollout.rollout.Versions()
+}
+
+// Generation provides the generation of the underlying rollout (or 0 if it
+// has none) plus the number of times a version has been forced to 0 or
+// cleared.
+func (guardedRollout *GuardedRollout) Generation() uint64 {
+	guardedRollout.mutex.RLock()
+	generation := guardedRollout.changes
+	guardedRollout.mutex.RUnlock()
+	if generational, ok := guardedRollout.rollout.(GenerationalRollout); ok {
+		generation += generational.Generation()
+	}
+	return generation
+}
+
+// Rules provides the targeting rules of the underlying rollout, if it has any,
+// leaving out rules that pin a version that has been forced to 0.
+func (guardedRollout *GuardedRollout) Rules() []Rule {
+	targeted, ok := guardedRollout.rollout.(TargetedRollout)
+	if !ok {
+		return nil
+	}
+	var rules []Rule
+	guardedRollout.mutex.RLock()
+	defer guardedRollout.mutex.RUnlock()
+	for _, rule := range targeted.Rules() {
+		if _, ok := guardedRollout.tripped[rule.Version]; !ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// States provides the state of every version of the underlying rollout, if it
+// is inspectable.
+func (guardedRollout *GuardedRollout) States() map[string]VersionState {
+	inspectable, ok := guardedRollout.rollout.(InspectableRollout)
+	if !ok {
+		return nil
+	}
+	return inspectable.States()
+}
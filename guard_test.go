@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type staticHealthSource map[string]VersionHealth
+
+func (source staticHealthSource) Health() (map[string]VersionHealth, error) {
+	return source, nil
+}
+
+func newTestGuardedRollout(t *testing.T, source HealthSource) *GuardedRollout {
+	guard, err := NewGuardedRollout(&NilMonitor{}, NewConstantRollout(0.5), source, time.Hour, 2, 100)
+	if err != nil {
+		t.Fatalf("error creating guard: %v", err)
+	}
+	return guard
+}
+
+func TestGuardedRolloutTrips(t *testing.T) {
+	guard := newTestGuardedRollout(t, staticHealthSource{
+		"master": {Requests: 10000, Errors: 10},
+		"canary": {Requests: 200, Errors: 20},
+	})
+	defer guard.Stop()
+	guard.check()
+	value := guard.Get("canary")
+	if value == nil || *value != 0 {
+		t.Fatalf("expected canary to be rolled back to 0, got %v", value)
+	}
+	if _, ok := guard.Tripped()["canary"]; !ok {
+		t.Fatalf("expected canary to be listed as tripped, got %v", guard.Tripped())
+	}
+	guard.Clear("canary")
+	value = guard.Get("canary")
+	if value == nil || *value != 0.5 {
+		t.Fatalf("expected canary value 0.5 after clearing, got %v", value)
+	}
+}
+
+func TestGuardedRolloutThresholds(t *testing.T) {
+	guard := newTestGuardedRollout(t, staticHealthSource{
+		"master": {Requests: 10000, Errors: 100},
+		"canary": {Requests: 200, Errors: 3},
+		"fresh":  {Requests: 10, Errors: 10},
+	})
+	defer guard.Stop()
+	guard.check()
+	if len(guard.Tripped()) != 0 {
+		t.Fatalf("expected nothing to be rolled back, got %v", guard.Tripped())
+	}
+}
+
+func TestFileHealthSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "health.json")
+	source := NewFileHealthSource(filename)
+	_, err = source.Health()
+	if err == nil {
+		t.Fatalf("expected an error for a missing health file")
+	}
+	err = ioutil.WriteFile(filename, []byte(`{"master": {"requests": 1000, "errors": 2}, "canary": {"requests": 40, "errors": 9}}`), 0644)
+	if err != nil {
+		t.Fatalf("Couldn't write health file: %v", err)
+	}
+	health, err := source.Health()
+	if err != nil {
+		t.Fatalf("unexpected error reading health file: %v", err)
+	}
+	if health["canary"].Errors != 9 || health["master"].Requests != 1000 {
+		t.Fatalf("unexpected health data %v", health)
+	}
+}
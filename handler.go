@@ -2,11 +2,30 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
 )
 
+// rolloutTolerance is the amount by which the sum of all version rollouts may
+// exceed 1.0 to allow for floating point error.
+const rolloutTolerance float64 = 1e-9
+
+// keyPrefix marks input holding a stable identifier (e.g. a user ID, session
+// cookie or IP address) rather than an assignment.
+const keyPrefix string = "key:"
+
+// reservedVersions are rollout entries that never receive a share of the
+// assignment space.
+var reservedVersions = map[string]bool{
+	"master":      true,
+	"maintenance": true,
+	rulesVersion:  true,
+}
+
 // Handler is an interface implemented by a value that can convert an input
 // value to some output value.
 type Handler interface {
@@ -14,11 +33,46 @@ type Handler interface {
 	Handle(string) string
 }
 
+// RequestHandler is an interface implemented by a Handler that can also make
+// use of the attributes of a request (e.g. to match targeting rules) and
+// describe its decision in detail.
+type RequestHandler interface {
+	Handler
+	// Decide is the method by which a request is converted to a decision.
+	Decide(*Request) Decision
+}
+
+// A Decision describes the outcome of handling a single request.
+type Decision struct {
+	// Assignment is the (possibly signed) assignment the client should
+	// keep.
+	Assignment string `json:"assignment"`
+	// Location is master or the name of a version.
+	Location string `json:"location"`
+	// Generation identifies the rollout values the decision was based on;
+	// it changes whenever they do, including when a ramp schedule advances
+	// to its next step.
+	Generation uint64 `json:"generation"`
+	// Reason describes why the location was chosen: "rollout", "rule <n>",
+	// or the problem that sent the request to master.
+	Reason string `json:"reason"`
+}
+
 // A CanaryHandler represents a handler that will determine a location
-// (master/canary) given an assignment.
+// (master or one of the rollout's versions) given an assignment.
+// The [0.0,1.0) assignment space is split into consecutive bands, one per
+// version ordered by name, each as wide as that version's rollout value;
+// "master" receives whatever remains.
+// Input of the form "key:<identifier>" is converted to an assignment by
+// hashing the identifier, so the same identifier is always given the same
+// assignment.
+// If the rollout provides targeting rules, the first rule matching a request
+// decides its location instead of its assignment.
 type CanaryHandler struct {
 	monitor Monitor
 	rollout Rollout
+	salt    string
+	signer  *AssignmentSigner
 }
 
 // NewCanaryHandler creates a handler that will calculate whether an assignment
@@ -30,41 +84,248 @@ func NewCanaryHandler(monitor Monitor, rollout Rollout) *CanaryHandler {
 	}
 }
 
-// Handle parses the given assignment and returns an assignment and
-// location (master/canary) each suffixed with a newline ('\n').
+// WithSalt sets the salt mixed into every hashed identifier, so that different
+// salts (e.g. one per application) produce unrelated cohorts.
+func (canaryHandler *CanaryHandler) WithSalt(salt string) *CanaryHandler {
+	canaryHandler.salt = salt
+	return canaryHandler
+}
+
+// WithSigner sets the signer used to sign returned assignments and verify
+// given assignments.
+func (canaryHandler *CanaryHandler) WithSigner(signer *AssignmentSigner) *CanaryHandler {
+	canaryHandler.signer = signer
+	return canaryHandler
+}
+
+// hashAssignment deterministically converts an identifier to an assignment in
+// the range [0.0,1.0).
+func (canaryHandler *CanaryHandler) hashAssignment(key string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(canaryHandler.salt))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	// FNV-1a mixes its high bits poorly for similar keys; apply the murmur3
+	// finalizer before keeping the 53 bits that fit in a float64 mantissa
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return float64(sum>>11) / (1 << 53)
+}
+
+// bands provides the upper bound of each version's band, ordered by version
+// name.
+// An error is returned if any rollout value, or their sum, is out of range.
+func (canaryHandler *CanaryHandler) bands() ([]string, []float64, error) {
+	var names []string
+	for _, name := range canaryHandler.rollout.Versions() {
+		if !reservedVersions[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	uppers := make([]float64, len(names))
+	upper := 0.0
+	for i, name := range names {
+		rolloutP := canaryHandler.rollout.Get(name)
+		rollout := 0.0
+		if rolloutP != nil {
+			rollout = *rolloutP
+		}
+		if rollout < 0 || rollout > 1 {
+			return nil, nil, fmt.Errorf("rollout of \"%v\" out of range", name)
+		}
+		upper += rollout
+		uppers[i] = upper
+	}
+	if upper > 1+rolloutTolerance {
+		return nil, nil, fmt.Errorf("total rollout out of range")
+	}
+	return names, uppers, nil
+}
+
+// target provides the location pinned by the first targeting rule matching
+// the given request, among the given versions, along with the rule's position
+// (starting at 1).
+// false is returned if no rule matches, or the matching rule pins a version
+// that is unknown or stale.
+func (canaryHandler *CanaryHandler) target(request *Request, names []string) (string, int, bool) {
+	targeted, ok := canaryHandler.rollout.(TargetedRollout)
+	if !ok {
+		return "", 0, false
+	}
+	for i, rule := range targeted.Rules() {
+		if !rule.Matches(request) {
+			continue
+		}
+		if rule.Version == "master" {
+			return rule.Version, i + 1, true
+		}
+		for _, name := range names {
+			if name == rule.Version && canaryHandler.rollout.Get(name) != nil {
+				return name, i + 1, true
+			}
+		}
+		log.Printf("handler: rule pins unavailable version \"%v\"\n", rule.Version)
+		return "", 0, false
+	}
+	return "", 0, false
+}
+
+// decision creates a decision for the given assignment (signed, if a signer
+// is set) and location.
+func (canaryHandler *CanaryHandler) decision(assignment float64, location string, generation uint64, reason string) Decision {
+	formatted := fmt.Sprintf("%v", assignment)
+	if canaryHandler.signer != nil {
+		formatted = canaryHandler.signer.Sign(formatted)
+	}
+	return Decision{
+		Assignment: formatted,
+		Location:   location,
+		Generation: generation,
+		Reason:     reason,
+	}
+}
+
+// Handle parses the given assignment (or hashes the given "key:" identifier)
+// and returns an assignment and location (master or a version name) each
+// suffixed with a newline ('\n').
+// If a signer is set, given assignments must carry a valid signature (so
+// "key:" input is rejected as unsigned) and returned assignments are signed.
 // A valid return value will always be produced (regardless of input).
 func (canaryHandler *CanaryHandler) Handle(input string) string {
-	format := "%v\n%v\n"
+	decision := canaryHandler.Decide(&Request{Input: input})
+	return fmt.Sprintf("%v\n%v\n", decision.Assignment, decision.Location)
+}
+
+// Decide handles the input of the given request exactly as Handle does, except
+// that targeting rules are matched against the request's attributes.
+// The identifier of "key:" input only decides the assignment: the request's
+// key matched by targeting rules is the one the proxy gave, if any.
+// If a signer is set, "key:" input is only hashed if it holds the request's
+// key, which only the proxy gives (as the key of a structured request or the
+// HTTP server's key header).
+func (canaryHandler *CanaryHandler) Decide(request *Request) Decision {
+	var generation uint64
+	if generational, ok := canaryHandler.rollout.(GenerationalRollout); ok {
+		generation = generational.Generation()
+	}
+	input := request.Input
+	trusted := false
+	if strings.HasPrefix(input, keyPrefix) && len(input) > len(keyPrefix) {
+		key := input[len(keyPrefix):]
+		// a client could try keys until one hashes into a version, so a
+		// signer only trusts the key the proxy gave as the request's key
+		if canaryHandler.signer == nil || key == request.Key {
+			input = fmt.Sprintf("%v", canaryHandler.hashAssignment(key))
+			trusted = true
+		}
+	}
 	if len(input) == 0 {
 		input = fmt.Sprintf("%v", rand.Float64())
+		trusted = true
 	}
 	value := "master"
+	if canaryHandler.signer != nil && !trusted {
+		verified, err := canaryHandler.signer.Verify(input)
+		if err != nil {
+			canaryHandler.monitor.RecordHandling(value, err)
+			log.Printf("handler: could not verify assignment: %v\n", err)
+			return canaryHandler.decision(rand.Float64(), value, generation, "unverified assignment")
+		}
+		input = verified
+	}
 	assignment, err := strconv.ParseFloat(input, 64)
 	if err != nil {
 		canaryHandler.monitor.RecordHandling(value, err)
 		log.Printf("handler: could not parse assignment as a number: %v\n", err)
-		return fmt.Sprintf(format, rand.Float64(), value)
+		return canaryHandler.decision(rand.Float64(), value, generation, "invalid assignment")
 	}
 	if assignment < 0 || assignment >= 1 {
 		canaryHandler.monitor.RecordHandling(value, fmt.Errorf("assignment out of range"))
 		log.Printf("handler: assignment is out of [0.0,1.0) range: %v\n", assignment)
-		return fmt.Sprintf(format, rand.Float64(), value)
+		return canaryHandler.decision(rand.Float64(), value, generation, "invalid assignment")
 	}
-	rolloutP := canaryHandler.rollout.Get("canary")
-	rollout := 0.0
-	if rolloutP != nil {
-		rollout = *rolloutP
+	names, uppers, err := canaryHandler.bands()
+	if err != nil {
+		canaryHandler.monitor.RecordHandling(value, err)
+		log.Printf("handler: %v\n", err)
+		return canaryHandler.decision(assignment, value, generation, "invalid rollout")
 	}
-	if rollout < 0 || rollout > 1 {
-		canaryHandler.monitor.RecordHandling(value, fmt.Errorf("rollout out of range"))
-		log.Printf("handler: rollout is out of [0.0,1.0] range\n")
-		return fmt.Sprintf(format, assignment, value)
+	if location, position, ok := canaryHandler.target(request, names); ok {
+		canaryHandler.monitor.RecordHandling(location, nil)
+		return canaryHandler.decision(assignment, location, generation, fmt.Sprintf("rule %v", position))
 	}
-	if assignment < rollout {
-		value = "canary"
+	for i, upper := range uppers {
+		if assignment < upper {
+			value = names[i]
+			break
+		}
 	}
 	canaryHandler.monitor.RecordHandling(value, nil)
-	return fmt.Sprintf(format, assignment, value)
+	return canaryHandler.decision(assignment, value, generation, "rollout")
+}
+
+// An ApplicationHandler represents a handler that passes each request to the
+// handler of the application it names.
+// Requests that do not name an application (including every request of the
+// original line protocol) are passed to the default application's handler;
+// requests naming an unknown application are sent to "master" with a random
+// (unsigned) assignment.
+type ApplicationHandler struct {
+	handlers           map[string]Handler
+	defaultApplication string
+}
+
+// NewApplicationHandler creates a handler whose default application is the
+// given application.
+// Handlers must be added for each application before use.
+func NewApplicationHandler(defaultApplication string) *ApplicationHandler {
+	return &ApplicationHandler{
+		handlers:           make(map[string]Handler),
+		defaultApplication: defaultApplication,
+	}
+}
+
+// Add sets the handler of the given application.
+func (applicationHandler *ApplicationHandler) Add(application string, handler Handler) *ApplicationHandler {
+	applicationHandler.handlers[application] = handler
+	return applicationHandler
+}
+
+// Handle passes the given input to the default application's handler.
+func (applicationHandler *ApplicationHandler) Handle(input string) string {
+	return applicationHandler.handlers[applicationHandler.defaultApplication].Handle(input)
+}
+
+// Decide passes the given request to the handler of the application it names.
+func (applicationHandler *ApplicationHandler) Decide(request *Request) Decision {
+	application := request.Application
+	if application == "" {
+		application = applicationHandler.defaultApplication
+	}
+	handler, ok := applicationHandler.handlers[application]
+	if !ok {
+		log.Printf("handler: request for unknown application \"%v\"\n", application)
+		return Decision{
+			Assignment: fmt.Sprintf("%v", rand.Float64()),
+			Location:   "master",
+			Reason:     "unknown application",
+		}
+	}
+	decision, err := decide(handler, request)
+	if err != nil {
+		log.Printf("handler: %v\n", err)
+		return Decision{
+			Assignment: fmt.Sprintf("%v", rand.Float64()),
+			Location:   "master",
+			Reason:     err.Error(),
+		}
+	}
+	return decision
 }
 
 // An EchoHandler represents a handler that will return the given input with no
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"net"
 	"strings"
 	"testing"
 )
@@ -20,6 +22,35 @@ func wellformed(s string) bool {
 	return strings.HasSuffix(s, "\nmaster\n") || strings.HasSuffix(s, "\ncanary\n")
 }
 
+// mapRollout is a rollout with a fixed value per version.
+type mapRollout map[string]float64
+
+func (m mapRollout) Get(name string) *float64 {
+	value, ok := m[name]
+	if !ok {
+		return nil
+	}
+	return &value
+}
+
+func (m mapRollout) Versions() []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
+
+// targetedMapRollout is a mapRollout with fixed targeting rules.
+type targetedMapRollout struct {
+	mapRollout
+	rules []Rule
+}
+
+func (m targetedMapRollout) Rules() []Rule {
+	return m.rules
+}
+
 func TestCanaryHandler0(t *testing.T) {
 	rollout := NewConstantRollout(0)
 	handler := NewCanaryHandler(&NilMonitor{}, rollout)
@@ -57,6 +88,79 @@ func TestCanaryHandler50(t *testing.T) {
 	}
 }
 
+func TestCanaryHandlerBands(t *testing.T) {
+	rollout := mapRollout{
+		"canary-b":    0.25,
+		"canary-a":    0.1,
+		"maintenance": 1,
+	}
+	handler := NewCanaryHandler(&NilMonitor{}, rollout)
+	cases := map[string]string{
+		"0":     "canary-a",
+		"0.099": "canary-a",
+		"0.1":   "canary-b",
+		"0.349": "canary-b",
+		"0.35":  "master",
+		"0.999": "master",
+	}
+	for assignment, location := range cases {
+		result := handler.Handle(assignment)
+		expected := assignment + "\n" + location + "\n"
+		if result != expected {
+			t.Errorf("expected %q for assignment %v, got %q", expected, assignment, result)
+		}
+	}
+}
+
+func TestCanaryHandlerBandsOverflow(t *testing.T) {
+	rollout := mapRollout{
+		"canary-a": 0.6,
+		"canary-b": 0.6,
+	}
+	handler := NewCanaryHandler(&NilMonitor{}, rollout)
+	for i := 0; i < 4096; i++ {
+		result := handler.Handle("")
+		if !strings.HasSuffix(result, "\nmaster\n") {
+			t.Fatalf("expected master when total rollout exceeds 1, got %q", result)
+		}
+	}
+}
+
+func TestCanaryHandlerKey(t *testing.T) {
+	rollout := NewConstantRollout(0.5)
+	handler := NewCanaryHandler(&NilMonitor{}, rollout)
+	canaried := 0
+	for i := 0; i < 4096; i++ {
+		key := fmt.Sprintf("key:user-%v", i)
+		result := handler.Handle(key)
+		if !wellformed(result) {
+			t.Fatalf("invalid result: %v", result)
+		}
+		if handler.Handle(key) != result {
+			t.Fatalf("key %v was assigned inconsistently", key)
+		}
+		assignment := strings.Fields(result)[0]
+		if handler.Handle(assignment) != result {
+			t.Fatalf("assignment %v for key %v does not round-trip", assignment, key)
+		}
+		if strings.HasSuffix(result, "\ncanary\n") {
+			canaried++
+		}
+	}
+	if canaried < 1792 || canaried > 2304 {
+		t.Errorf("expected roughly half of keys canaried, got %v of 4096", canaried)
+	}
+}
+
+func TestCanaryHandlerKeySalt(t *testing.T) {
+	rollout := NewConstantRollout(0.5)
+	first := NewCanaryHandler(&NilMonitor{}, rollout).WithSalt("first")
+	second := NewCanaryHandler(&NilMonitor{}, rollout).WithSalt("second")
+	if first.Handle("key:user") == second.Handle("key:user") {
+		t.Fatalf("different salts produced the same assignment")
+	}
+}
+
 func TestCanaryHandlerInvalidRollout(t *testing.T) {
 	rollout := NewConstantRollout(-1.0)
 	handler := NewCanaryHandler(&NilMonitor{}, rollout)
@@ -98,3 +202,62 @@ func BenchmarkCanaryHandlerCanary(b *testing.B) {
 		_ = handler.Handle("")
 	}
 }
+
+func TestCanaryHandlerRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`[{"version": "master", "users": ["vip"]}, {"version": "canary", "networks": ["10.0.0.0/8"]}, {"version": "gone", "users": ["qa"]}]`))
+	if err != nil {
+		t.Fatalf("error parsing rules: %v", err)
+	}
+	rollout := targetedMapRollout{mapRollout{"canary": 0}, rules}
+	handler := NewCanaryHandler(&NilMonitor{}, rollout)
+	cases := []struct {
+		request  Request
+		location string
+	}{
+		{Request{Input: "0.5", IP: net.ParseIP("10.0.0.1")}, "canary"},
+		{Request{Input: "key:vip", Key: "vip", IP: net.ParseIP("10.0.0.1")}, "master"},
+		{Request{Input: "0.5", IP: net.ParseIP("127.0.0.1")}, "master"},
+		{Request{Input: "key:qa", Key: "qa"}, "master"},
+	}
+	for _, c := range cases {
+		decision := handler.Decide(&c.request)
+		if decision.Location != c.location {
+			t.Errorf("expected location %v for %+v, got %+v", c.location, c.request, decision)
+		}
+	}
+	rollout.mapRollout["canary"] = 1
+	decision := handler.Decide(&Request{Input: "key:vip", Key: "vip"})
+	if decision.Location != "master" || decision.Reason != "rule 1" {
+		t.Fatalf("expected excluded user to stay on master by rule 1, got %+v", decision)
+	}
+	// a client naming a user in its input is not that user
+	decision = handler.Decide(&Request{Input: "key:vip"})
+	if decision.Location != "canary" || decision.Reason != "rollout" {
+		t.Fatalf("expected a key chosen by the client to match no rule, got %+v", decision)
+	}
+}
+
+func TestApplicationHandler(t *testing.T) {
+	handler := NewApplicationHandler("website").
+		Add("website", NewCanaryHandler(&NilMonitor{}, NewConstantRollout(0))).
+		Add("api", NewCanaryHandler(&NilMonitor{}, NewConstantRollout(1)))
+	cases := []struct {
+		application string
+		location    string
+		reason      string
+	}{
+		{"", "master", "rollout"},
+		{"website", "master", "rollout"},
+		{"api", "canary", "rollout"},
+		{"unknown", "master", "unknown application"},
+	}
+	for _, c := range cases {
+		decision := handler.Decide(&Request{Application: c.application, Input: "0.5"})
+		if decision.Location != c.location || decision.Reason != c.reason {
+			t.Errorf("expected %v (%v) for application %q, got %+v", c.location, c.reason, c.application, decision)
+		}
+	}
+	if result := handler.Handle("0.5"); result != "0.5\nmaster\n" {
+		t.Fatalf("expected the default application to handle unstructured input, got %q", result)
+	}
+}
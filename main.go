@@ -2,78 +2,409 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
-	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+// options holds every setting of the daemon.
+// Each is defined as a flag, and so can also be set in a config file (see
+// ParseConfig) named by the -config flag.
+type options struct {
+	config           *string
+	application      *string
+	delay            *time.Duration
+	unhealthy        *time.Duration
+	logfile          *string
+	stateDir         *string
+	signingKeys      *string
+	adminAddress     *string
+	guardSource      *string
+	guardInterval    *time.Duration
+	guardMaxRatio    *float64
+	guardMinRequests *float64
+	upgradeTimeout   *time.Duration
+	salt             *string
+	dogStatsDPort    *uint
+	dogStatsDAddress *string
+	rolloutName      *string
+	rolloutCreators  map[string]rolloutCreator
+	monitorName      *string
+	monitorCreators  map[string]monitorCreator
+	serverNames      *string
+	serverCreators   map[string]serverCreator
+}
+
+// defineOptions defines the flag of every setting on the given flag set.
+func defineOptions(fs *flag.FlagSet) *options {
+	opts := &options{
+		config:           fs.String("config", "", "path to a config file of flag settings, re-read on SIGHUP (flags given on the command line take precedence)"),
+		application:      fs.String("application", "app", "comma-separated application names (referenced by the rollout backend); the first is the default"),
+		delay:            fs.Duration("delay", 4*time.Second, "minimum delay between rollout requests"),
+		unhealthy:        fs.Duration("unhealthy", 8*time.Second, "minimum duration to allow unhealthy rollout querying before reverting to 0.0 rollout"),
+		logfile:          fs.String("logfile", "/var/log/maxwells-daemon.log", "path to the log file"),
+		stateDir:         fs.String("state-dir", "/var/lib/maxwells-daemon", "path to the app's state directory"),
+		signingKeys:      fs.String("signing-keys", "", "path to a file of assignment signing keys (disables unsigned assignments)"),
+		adminAddress:     fs.String("admin", "", "listen address for the admin HTTP API (empty disables it)"),
+		guardSource:      fs.String("guard.source", "", "health data for automatic rollback: a JSON file path or an http:// URL (\"{application}\" is replaced by the application name; empty disables it)"),
+		guardInterval:    fs.Duration("guard.interval", 10*time.Second, "delay between health data checks"),
+		guardMaxRatio:    fs.Float64("guard.max-ratio", 2, "error rate, as a multiple of master's, above which a version is rolled back"),
+		guardMinRequests: fs.Float64("guard.min-requests", 100, "requests a version must have served before it can be rolled back"),
+		upgradeTimeout:   fs.Duration("upgrade-timeout", 30*time.Second, "how long a new process started by SIGUSR2 may take to begin serving before the upgrade is abandoned"),
+		salt:             fs.String("hash-salt", "", "salt mixed into hashed \"key:\" identifiers (\"{application}\" is replaced by the application name, giving each its own cohorts)"),
+		// the DogStatsD agent's location is defined here rather than by
+		// its backend, as reloadOptions can change it while the daemon runs
+		dogStatsDPort:    fs.Uint("dogstatsd.port", 8125, "UDP port of the local DogStatsD agent (used when -dogstatsd.address is empty)"),
+		dogStatsDAddress: fs.String("dogstatsd.address", "", "address of the DogStatsD agent: <host>:<port> for UDP, or unix://<path> for a Unix datagram socket"),
+	}
+	opts.rolloutName, opts.rolloutCreators = defineRollouts(fs, "dynamodb")
+	opts.monitorName, opts.monitorCreators = defineMonitors(fs, "dogstatsd")
+	opts.serverNames, opts.serverCreators = defineServers(fs, "unix")
+	return opts
+}
+
+// loadOptions parses the given command-line arguments followed by the config
+// file they name (if any), and validates the result.
+func loadOptions(name string, args []string, errorHandling flag.ErrorHandling) (*flag.FlagSet, *options, error) {
+	fs := flag.NewFlagSet(name, errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		fs.SetOutput(ioutil.Discard)
+	}
+	opts := defineOptions(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *opts.config != "" {
+		err = applyConfigFile(fs, *opts.config)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = opts.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fs, opts, nil
+}
+
+// applications provides the names listed by the -application flag.
+func (opts *options) applications() ([]string, error) {
+	var applications []string
+	for _, name := range strings.Split(*opts.application, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		for _, existing := range applications {
+			if existing == name {
+				return nil, fmt.Errorf("application \"%v\" is listed twice", name)
+			}
+		}
+		applications = append(applications, name)
+	}
+	if len(applications) == 0 {
+		return nil, fmt.Errorf("no application given")
+	}
+	return applications, nil
+}
+
+// validate checks the settings that can be checked before anything is
+// created.
+func (opts *options) validate() error {
+	if _, err := opts.applications(); err != nil {
+		return err
+	}
+	if *opts.delay <= 0 {
+		return fmt.Errorf("delay must be positive")
+	}
+	if *opts.unhealthy <= 0 {
+		return fmt.Errorf("unhealthy duration must be positive")
+	}
+	if *opts.guardMaxRatio <= 0 {
+		return fmt.Errorf("maximum error ratio must be positive")
+	}
+	if *opts.dogStatsDPort > 65535 {
+		return fmt.Errorf("DogStatsD port %v is out of range", *opts.dogStatsDPort)
+	}
+	// a rolled back version can only be cleared through the admin API
+	if *opts.guardSource != "" && *opts.adminAddress == "" {
+		return fmt.Errorf("guard requires the admin API (-admin) to clear rolled back versions")
+	}
+	if _, ok := opts.rolloutCreators[*opts.rolloutName]; !ok {
+		return fmt.Errorf("unknown rollout backend \"%v\"", *opts.rolloutName)
+	}
+	for _, monitorName := range strings.Split(*opts.monitorName, ",") {
+		if _, ok := opts.monitorCreators[monitorName]; !ok {
+			return fmt.Errorf("unknown monitor backend \"%v\"", monitorName)
+		}
+	}
+	for _, serverName := range strings.Split(*opts.serverNames, ",") {
+		if _, ok := opts.serverCreators[serverName]; !ok {
+			return fmt.Errorf("unknown server backend \"%v\"", serverName)
+		}
+	}
+	return nil
+}
+
 // TODO: Try github.com/golang/glog
 func main() {
-	socket := flag.String("socket", "/tmp/maxwells-daemon.sock", "path to the unix socket file")
-	application := flag.String("application", "app", "application name (referenced by DynamoDB)")
-	region := flag.String("region", "us-east-1", "AWS region for DynamoDB")
-	table := flag.String("table", "MaxwellsDaemon", "DynamoDB table used for rollout data")
-	delay := flag.Duration("delay", 4*time.Second, "minimum delay between DynamoDB rollout requests")
-	unhealthy := flag.Duration("unhealthy", 8*time.Second, "minimum duration to allow unhealthy DynamoDB querying before reverting to 0.0 rollout")
-	logfile := flag.String("logfile", "/var/log/maxwells-daemon.log", "path to the log file")
-	stateDir := flag.String("state-dir", "/var/lib/maxwells-daemon", "path to the app's state directory")
-	flag.Parse()
+	fs, opts, err := loadOptions(os.Args[0], os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
 
 	rand.Seed(time.Now().UTC().UnixNano())
-	handle, err := os.OpenFile(*logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	handle, err := os.OpenFile(*opts.logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		log.Printf("error opening log file: %v: %v", *logfile, err)
+		log.Printf("error opening log file: %v: %v", *opts.logfile, err)
 	}
 	log.SetOutput(handle)
 
-	// monitor
-	monitor := NewDogStatsDMonitor(8125)
-
-	// rollout
-	client := &http.Client{
-		Timeout: time.Second,
+	err = inheritListeners()
+	if err != nil {
+		log.Fatalf("error inheriting listeners: %v\n", err)
 	}
-	config := aws.NewConfig().WithRegion(*region).WithHTTPClient(client).WithMaxRetries(2)
-	db := dynamodb.New(session.New(), config)
-	rollout, err := NewDynamoDBRollout(monitor, db, *table, *application, *delay, *unhealthy)
+	err = activateListeners()
 	if err != nil {
-		log.Fatalf("error creating rollout: %v\n", err)
+		log.Fatalf("error activating listeners: %v\n", err)
 	}
 
-	// handler
-	handler := NewCanaryHandler(monitor, rollout)
+	applications, _ := opts.applications()
+	config := &backendConfig{
+		application:      applications[0],
+		delay:            *opts.delay,
+		unhealthy:        *opts.unhealthy,
+		stateDir:         *opts.stateDir,
+		dogStatsDAddress: dogStatsDAddress(opts.dogStatsDAddress, opts.dogStatsDPort),
+	}
 
-	// maintenance daemon
-	maintenance, err := NewMaintenanceDaemon(path.Join(*stateDir, "maintenance", *application), monitor, rollout)
-	if err != nil {
-		log.Fatal("error creating maintenance daemon: %v\n", err)
+	// monitor
+	var monitors []Monitor
+	for _, monitorName := range strings.Split(*opts.monitorName, ",") {
+		created, err := opts.monitorCreators[monitorName](config)
+		if err != nil {
+			log.Fatalf("error creating %v monitor: %v\n", monitorName, err)
+		}
+		monitors = append(monitors, created)
+	}
+	monitor := monitors[0]
+	if len(monitors) > 1 {
+		monitor = NewFanoutMonitor(monitors...)
 	}
 
-	// server
-	os.Remove(*socket)
-	server, err := NewUnixServer(monitor, handler, *socket)
-	if err != nil {
-		log.Fatalf("error starting server: %v\n", err)
+	var signer *AssignmentSigner
+	if *opts.signingKeys != "" {
+		signer, err = LoadAssignmentSigner(*opts.signingKeys)
+		if err != nil {
+			log.Fatalf("error loading signing keys: %v\n", err)
+		}
+	}
+
+	newRollout := opts.rolloutCreators[*opts.rolloutName]
+	handler := NewApplicationHandler(applications[0])
+	var maintenances []*MaintenanceDaemon
+	var overrideRollouts []*OverrideRollout
+	var guards []*GuardedRollout
+	var tunables []TunableRollout
+	for _, name := range applications {
+		applicationConfig := *config
+		applicationConfig.application = name
+		applicationMonitor := monitorForApplication(monitor, name)
+
+		// rollout
+		rollout, err := newRollout(applicationMonitor, &applicationConfig)
+		if err != nil {
+			log.Fatalf("error creating rollout of \"%v\": %v\n", name, err)
+		}
+		if tunable, ok := rollout.(TunableRollout); ok {
+			tunables = append(tunables, tunable)
+		}
+		if *opts.adminAddress != "" {
+			overrideRollout := NewOverrideRollout(rollout)
+			overrideRollouts = append(overrideRollouts, overrideRollout)
+			rollout = overrideRollout
+		}
+		if *opts.guardSource != "" {
+			guardSource := strings.Replace(*opts.guardSource, "{application}", name, -1)
+			var source HealthSource = NewFileHealthSource(guardSource)
+			if strings.HasPrefix(guardSource, "http://") || strings.HasPrefix(guardSource, "https://") {
+				source = NewHTTPHealthSource(guardSource)
+			}
+			guard, err := NewGuardedRollout(applicationMonitor, rollout, source, *opts.guardInterval, *opts.guardMaxRatio, *opts.guardMinRequests)
+			if err != nil {
+				log.Fatalf("error creating guard of \"%v\": %v\n", name, err)
+			}
+			guards = append(guards, guard)
+			rollout = guard
+		}
+		if observer, ok := applicationMonitor.(RolloutObserver); ok {
+			observer.ObserveRollout(rollout)
+		}
+
+		// handler
+		canaryHandler := NewCanaryHandler(applicationMonitor, rollout).WithSalt(strings.Replace(*opts.salt, "{application}", name, -1))
+		if signer != nil {
+			canaryHandler.WithSigner(signer)
+		}
+		handler.Add(name, canaryHandler)
+
+		// maintenance daemon
+		maintenance, err := NewMaintenanceDaemon(path.Join(*opts.stateDir, "maintenance", name), applicationMonitor, rollout)
+		if err != nil {
+			log.Fatalf("error creating maintenance daemon of \"%v\": %v\n", name, err)
+		}
+		maintenances = append(maintenances, maintenance)
+	}
+
+	// servers
+	var server ServerGroup
+	for _, serverName := range strings.Split(*opts.serverNames, ",") {
+		created, err := opts.serverCreators[serverName](monitor, handler, config)
+		if err != nil {
+			log.Fatalf("error starting %v server: %v\n", serverName, err)
+		}
+		server = append(server, created)
+	}
+
+	// admin server
+	var admin *AdminServer
+	if *opts.adminAddress != "" {
+		admin, err = NewAdminServer(*opts.adminAddress, applications, overrideRollouts, guards, maintenances)
+		if err != nil {
+			log.Fatalf("error starting admin server: %v\n", err)
+		}
 	}
 
 	// endless waiting (signal handler)
 	sigchan := make(chan os.Signal, 1024)
-	signal.Notify(sigchan, os.Interrupt)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	notifyReady()
 	log.Printf("started daemon\n")
-	select {
-	case <-sigchan:
+	code := 0
+	for sig := range sigchan {
+		if sig == syscall.SIGHUP {
+			log.Printf("received hangup signal\n")
+			reloaded, _, err := loadOptions(os.Args[0], os.Args[1:], flag.ContinueOnError)
+			if err != nil {
+				log.Printf("config: not reloading: %v\n", err)
+				continue
+			}
+			reloadOptions(fs, opts, reloaded, tunables, guards, monitor)
+			continue
+		}
+		if sig == syscall.SIGUSR2 {
+			log.Printf("received upgrade signal\n")
+			err := Upgrade(*opts.upgradeTimeout)
+			if err != nil {
+				log.Printf("server: not upgrading: %v\n", err)
+				continue
+			}
+			log.Printf("server: handed listeners over to the new process\n")
+			break
+		}
+		if sig == syscall.SIGTERM {
+			log.Printf("received terminate signal\n")
+			break
+		}
 		log.Printf("received interrupt signal\n")
-		server.Close()
-		handle.Close()
+		code = 130
+		break
+	}
+	// drain connections
+	server.Close()
+	if admin != nil {
+		admin.Close()
+	}
+	for _, guard := range guards {
+		guard.Stop()
+	}
+	for _, maintenance := range maintenances {
 		maintenance.Stop()
-		os.Exit(130)
+	}
+	if closer, ok := monitor.(io.Closer); ok {
+		closer.Close()
+	}
+	log.Printf("stopped daemon\n")
+	handle.Close()
+	os.Exit(code)
+}
+
+// liveOptions are the settings that reloadOptions can change while the daemon
+// runs.
+var liveOptions = map[string]bool{
+	"delay":              true,
+	"unhealthy":          true,
+	"guard.max-ratio":    true,
+	"guard.min-requests": true,
+	"dogstatsd.port":     true,
+	"dogstatsd.address":  true,
+}
+
+// reloadOptions copies every changed setting of the reloaded flag set that can
+// be changed live to the current flag set (and so to opts, defined on it) and
+// applies it to the given rollouts, guards and monitor.
+// Every other changed setting is logged and left as it was.
+func reloadOptions(current *flag.FlagSet, opts *options, reloaded *flag.FlagSet, tunables []TunableRollout, guards []*GuardedRollout, monitor Monitor) {
+	changed := changedFlags(current, reloaded)
+	var names []string
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	applied := make(map[string]bool)
+	for _, name := range names {
+		if !liveOptions[name] {
+			log.Printf("config: cannot change \"%v\" from %q to %q without a restart\n", name, current.Lookup(name).Value.String(), changed[name])
+			continue
+		}
+		if name == "dogstatsd.port" || name == "dogstatsd.address" {
+			statsdMonitor, ok := monitor.(*DogStatsDMonitor)
+			if fanoutMonitor, isFanout := monitor.(*FanoutMonitor); isFanout {
+				for _, child := range fanoutMonitor.Monitors() {
+					if child, isStatsd := child.(*DogStatsDMonitor); isStatsd {
+						statsdMonitor, ok = child, true
+					}
+				}
+			}
+			if !ok {
+				log.Printf("config: cannot change \"%v\" to %q: DogStatsD is not in use\n", name, changed[name])
+				continue
+			}
+			previous := current.Lookup(name).Value.String()
+			current.Set(name, changed[name])
+			err := statsdMonitor.SetAddress(dogStatsDAddress(opts.dogStatsDAddress, opts.dogStatsDPort))
+			if err != nil {
+				current.Set(name, previous)
+				log.Printf("config: cannot change \"%v\" to %q: %v\n", name, changed[name], err)
+				continue
+			}
+		}
+		current.Set(name, changed[name])
+		applied[name] = true
+		log.Printf("config: changed \"%v\" to %q\n", name, changed[name])
+	}
+	if applied["delay"] || applied["unhealthy"] {
+		for _, tunable := range tunables {
+			tunable.Tune(*opts.delay, *opts.unhealthy)
+		}
+	}
+	if applied["guard.max-ratio"] || applied["guard.min-requests"] {
+		for _, guard := range guards {
+			err := guard.SetThresholds(*opts.guardMaxRatio, *opts.guardMinRequests)
+			if err != nil {
+				log.Printf("config: %v\n", err)
+			}
+		}
 	}
 }
@@ -10,17 +10,25 @@ import (
 
 // A MaintenanceDaemon is a structure to continually update the existence of a
 // file depending on whether or not maintenance mode is enabled.
+// Every time the file is created or removed, the transition is recorded to the
+// daemon's monitor.
 type MaintenanceDaemon struct {
 	fullpath string
+	monitor  Monitor
 	ch       chan interface{}
 	wg       *sync.WaitGroup
 	rwm      *sync.RWMutex
 }
 
 func (md *MaintenanceDaemon) on() {
+	wasOn := md.IsOn()
 	_, err := os.Create(md.fullpath)
 	if err != nil {
 		log.Printf("maintenance: could not create maintenance file")
+		return
+	}
+	if !wasOn {
+		md.monitor.RecordMaintenance(true)
 	}
 }
 
@@ -29,6 +37,9 @@ func (md *MaintenanceDaemon) off() {
 	if err != nil && !os.IsNotExist(err) {
 		log.Printf("maintenance: could not remove maintenance file")
 	}
+	if err == nil {
+		md.monitor.RecordMaintenance(false)
+	}
 }
 
 func (md *MaintenanceDaemon) update(value *float64) {
@@ -50,6 +61,7 @@ func NewMaintenanceDaemon(fullpath string, monitor Monitor, rollout Rollout) (*M
 	}
 	md := &MaintenanceDaemon{
 		fullpath: fullpath,
+		monitor:  monitor,
 		ch:       make(chan interface{}),
 		wg:       &sync.WaitGroup{},
 		rwm:      &sync.RWMutex{},
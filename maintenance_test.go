@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path"
 	"testing"
@@ -31,7 +32,7 @@ func TestMaintenanceDaemonOn(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't create temp dir for testing: %v", err)
 	}
-	rollout := NewConstantRollout(1)
+	rollout := mapRollout{"maintenance": 1}
 	md, err := NewMaintenanceDaemon(fullpath, &NilMonitor{}, rollout)
 	if err != nil {
 		t.Fatalf("Failed creating MaintenanceDaemon: %v", err)
@@ -42,3 +43,45 @@ func TestMaintenanceDaemonOn(t *testing.T) {
 		t.Fatalf("Maintenance is off when it shouldn't be")
 	}
 }
+
+func TestMaintenanceDaemonConstantRollout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	fullpath := path.Join(dir, "test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	// a constant rollout only provides the canary's value
+	md, err := NewMaintenanceDaemon(fullpath, &NilMonitor{}, NewConstantRollout(0.05))
+	if err != nil {
+		t.Fatalf("Failed creating MaintenanceDaemon: %v", err)
+	}
+	defer md.Stop()
+	time.Sleep(8 * time.Millisecond)
+	if md.IsOn() {
+		t.Fatalf("Maintenance was turned on by a constant rollout")
+	}
+}
+
+func TestMaintenanceDaemonTransitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	fullpath := path.Join(dir, "test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	monitor := newStateMonitor()
+	md, err := NewMaintenanceDaemon(fullpath, monitor, NewConstantRollout(0))
+	if err != nil {
+		t.Fatalf("Failed creating MaintenanceDaemon: %v", err)
+	}
+	defer md.Stop()
+	on, off := 1.0, 0.0
+	for _, value := range []*float64{&on, &on, nil, &off, &off, &on} {
+		md.update(value)
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	expected := "[maintenance: true maintenance: false maintenance: true]"
+	if fmt.Sprint(monitor.transitions) != expected {
+		t.Fatalf("expected transitions %v, got %v", expected, monitor.transitions)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// servingTimeBuckets are the upper bounds, in seconds, of the serving time
+// histogram buckets.
+var servingTimeBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1,
+}
+
+// A metricStore holds the metrics recorded by a monitor and the monitors it
+// provides for each application, for the monitor to render in its own format
+// (see PrometheusMonitor and OTLPMonitor).
+// Metrics recorded for an application are keyed by its name first ("" if
+// none).
+// Every field is guarded by the mutex.
+type metricStore struct {
+	mutex          *sync.Mutex
+	serves         map[string]uint64
+	handlings      map[[3]string]uint64
+	rolloutUpdates map[[2]string]uint64
+	rollbacks      map[[2]string]uint64
+	// bucketCounts holds the serving times within each bucket (not those
+	// of lower buckets), followed by those above the last bound
+	bucketCounts []uint64
+	servingSum   float64
+	servingCount uint64
+	values       map[[2]string]float64
+	staleness    map[[2]string]float64
+	unhealthy    map[[2]string]bool
+	maintenance  map[string]bool
+}
+
+func newMetricStore() *metricStore {
+	return &metricStore{
+		mutex:          &sync.Mutex{},
+		serves:         map[string]uint64{"success": 0, "failure": 0},
+		handlings:      make(map[[3]string]uint64),
+		rolloutUpdates: make(map[[2]string]uint64),
+		rollbacks:      make(map[[2]string]uint64),
+		bucketCounts:   make([]uint64, len(servingTimeBuckets)+1),
+		values:         make(map[[2]string]float64),
+		staleness:      make(map[[2]string]float64),
+		unhealthy:      make(map[[2]string]bool),
+		maintenance:    make(map[string]bool),
+	}
+}
+
+// handlingKeys provides the keys of the handling counts in order.
+// The store must be locked.
+func (store *metricStore) handlingKeys() [][3]string {
+	var keys [][3]string
+	for key := range store.handlings {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		for k := range keys[i] {
+			if keys[i][k] != keys[j][k] {
+				return keys[i][k] < keys[j][k]
+			}
+		}
+		return false
+	})
+	return keys
+}
+
+// A metricRecorder implements the recording methods of a Monitor by recording
+// to a metricStore on behalf of an application ("" if none).
+type metricRecorder struct {
+	store       *metricStore
+	application string
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func (metricRecorder *metricRecorder) RecordServe(err error) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.serves[resultLabel(err)]++
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordServingTime(duration time.Duration) {
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(servingTimeBuckets, seconds)
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.bucketCounts[bucket]++
+	metricRecorder.store.servingSum += seconds
+	metricRecorder.store.servingCount++
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordHandling(location string, err error) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.handlings[[3]string{metricRecorder.application, location, resultLabel(err)}]++
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordRolloutUpdate(err error) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.rolloutUpdates[[2]string{metricRecorder.application, resultLabel(err)}]++
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordRollback(version string, _ string) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.rollbacks[[2]string{metricRecorder.application, version}]++
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordRolloutValue(version string, value float64) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.values[[2]string{metricRecorder.application, version}] = value
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordStaleness(version string, staleness time.Duration) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.staleness[[2]string{metricRecorder.application, version}] = staleness.Seconds()
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordUnhealthy(version string, unhealthy bool) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.unhealthy[[2]string{metricRecorder.application, version}] = unhealthy
+	metricRecorder.store.mutex.Unlock()
+}
+
+func (metricRecorder *metricRecorder) RecordMaintenance(on bool) {
+	metricRecorder.store.mutex.Lock()
+	metricRecorder.store.maintenance[metricRecorder.application] = on
+	metricRecorder.store.mutex.Unlock()
+}
+
+// sortPairs sorts the given label values by application, then by version.
+func sortPairs(pairs [][2]string) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+}
+
+// boolValue formats the given boolean as a gauge value.
+func boolValue(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
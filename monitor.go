@@ -1,9 +1,6 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"net"
 	"time"
 )
 
@@ -14,81 +11,59 @@ type Monitor interface {
 	RecordServingTime(time.Duration)
 	RecordHandling(string, error)
 	RecordRolloutUpdate(error)
+	RecordRollback(string, string)
+	// RecordRolloutValue records the rollout value a version is served at,
+	// each time the rollout is refreshed.
+	RecordRolloutValue(string, float64)
+	// RecordStaleness records how long ago a version was last read
+	// successfully, each time the rollout is refreshed.
+	RecordStaleness(string, time.Duration)
+	// RecordUnhealthy records a version going stale (true), or being read
+	// again after having gone stale (false).
+	RecordUnhealthy(string, bool)
+	// RecordMaintenance records maintenance mode being turned on (true) or
+	// off (false).
+	RecordMaintenance(bool)
 }
 
-// A DogStatsDMonitor represents a proxy for sending metrics to Datadog using
-// the namespace prefix "maxwellsdaemon.".
-type DogStatsDMonitor struct {
-	port uint16
-	conn net.Conn
+// A RolloutObserver is implemented by a monitor that reports the values of the
+// rollout in use directly.
+type RolloutObserver interface {
+	ObserveRollout(Rollout)
 }
 
-// NewDogStatsDMonitor creates a connection to the dogstatsd agent and prepares
-// to accept metrics.
-func NewDogStatsDMonitor(port uint16) *DogStatsDMonitor {
-	return &DogStatsDMonitor{
-		port: port,
-		conn: nil,
-	}
-}
-
-func (statsdMonitor *DogStatsDMonitor) send(s string) {
-	if statsdMonitor.conn == nil {
-		conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%v", statsdMonitor.port))
-		if err != nil {
-			log.Printf("monitor: could not connect to DogStatsD: %v\n", err)
-			return
-		}
-		statsdMonitor.conn = conn
-	}
-	written, err := statsdMonitor.conn.Write([]byte(s))
-	if err != nil || written != len([]byte(s)) {
-		log.Printf("monitor: error writing data to DogStatsD: %v\n", err)
-		_ = statsdMonitor.conn.Close()
-		statsdMonitor.conn = nil
-		return
-	}
+// A RequestTracer is implemented by a monitor that traces the phases of each
+// request served by the unix and tcp servers.
+type RequestTracer interface {
+	TraceRequest(*RequestTrace)
 }
 
-func (statsdMonitor *DogStatsDMonitor) RecordServe(err error) {
-	if err != nil {
-		statsdMonitor.send("maxwellsdaemon.server.success:0|c\n")
-		statsdMonitor.send("maxwellsdaemon.server.failure:1|c\n")
-	} else {
-		statsdMonitor.send("maxwellsdaemon.server.success:1|c\n")
-		statsdMonitor.send("maxwellsdaemon.server.failure:0|c\n")
-	}
-}
-
-func (statsdMonitor *DogStatsDMonitor) RecordServingTime(duration time.Duration) {
-	milliseconds := duration / time.Millisecond
-	statsdMonitor.send(fmt.Sprintf("maxwellsdaemon.server.delay:%v|h\n", milliseconds))
-}
-
-func (statsdMonitor *DogStatsDMonitor) RecordHandling(location string, err error) {
-	if err != nil {
-		statsdMonitor.send("maxwellsdaemon.handler.success:0|c\n")
-		statsdMonitor.send("maxwellsdaemon.handler.failure:1|c\n")
-	} else {
-		statsdMonitor.send("maxwellsdaemon.handler.success:1|c|#location:" + location + "\n")
-		statsdMonitor.send("maxwellsdaemon.handler.failure:0|c\n")
-	}
+// An ApplicationMonitor is implemented by a monitor that can label what it
+// records with the name of an application.
+type ApplicationMonitor interface {
+	// ForApplication provides a monitor that records to the same
+	// destination, labeled with the given application.
+	ForApplication(string) Monitor
 }
 
-func (statsdMonitor *DogStatsDMonitor) RecordRolloutUpdate(err error) {
-	if err != nil {
-		statsdMonitor.send("maxwellsdaemon.rollout.update.success:0|c\n")
-		statsdMonitor.send("maxwellsdaemon.rollout.update.failure:1|c\n")
-	} else {
-		statsdMonitor.send("maxwellsdaemon.rollout.update.success:1|c\n")
-		statsdMonitor.send("maxwellsdaemon.rollout.update.failure:0|c\n")
+// monitorForApplication provides a monitor labeled with the given application
+// if the given monitor supports it, otherwise the given monitor itself.
+func monitorForApplication(monitor Monitor, application string) Monitor {
+	if applicationMonitor, ok := monitor.(ApplicationMonitor); ok {
+		return applicationMonitor.ForApplication(application)
 	}
+	return monitor
 }
 
 // NilMonitor represents a monitor sink - it records nothing.
 type NilMonitor struct{}
 
-func (nilMonitor *NilMonitor) RecordServe(_ error)               {}
-func (nilMonitor *NilMonitor) RecordServingTime(_ time.Duration) {}
-func (nilMonitor *NilMonitor) RecordHandling(_ string, _ error)  {}
-func (nilMonitor *NilMonitor) RecordRolloutUpdate(_ error)       {}
+func (nilMonitor *NilMonitor) RecordServe(_ error)                       {}
+func (nilMonitor *NilMonitor) RecordServingTime(_ time.Duration)         {}
+func (nilMonitor *NilMonitor) RecordHandling(_ string, _ error)          {}
+func (nilMonitor *NilMonitor) RecordRolloutUpdate(_ error)               {}
+func (nilMonitor *NilMonitor) RecordRollback(_ string, _ string)         {}
+func (nilMonitor *NilMonitor) RecordRolloutValue(_ string, _ float64)    {}
+func (nilMonitor *NilMonitor) RecordStaleness(_ string, _ time.Duration) {}
+func (nilMonitor *NilMonitor) RecordUnhealthy(_ string, _ bool)          {}
+func (nilMonitor *NilMonitor) RecordMaintenance(_ bool)                  {}
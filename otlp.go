@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// otlpQueueSize is the number of traced requests that may wait to be exported
+// before further traces are dropped.
+const otlpQueueSize int = 4096
+
+// otlpBatchSize is the largest number of spans exported in a single request to
+// the collector.
+const otlpBatchSize int = 512
+
+// Values of enumerations of the OTLP data model.
+const (
+	otlpSpanKindInternal int = 1
+	otlpSpanKindServer   int = 2
+	otlpStatusError      int = 2
+	otlpCumulative       int = 2
+)
+
+// The following types are the parts of the OTLP/HTTP JSON encoding (see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding) that are
+// exported.
+// 64-bit integers are encoded as strings, and IDs in hexadecimal.
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogramDataPoint struct {
+	StartTimeUnixNano string    `json:"startTimeUnixNano"`
+	TimeUnixNano      string    `json:"timeUnixNano"`
+	Count             string    `json:"count"`
+	Sum               float64   `json:"sum"`
+	BucketCounts      []string  `json:"bucketCounts"`
+	ExplicitBounds    []float64 `json:"explicitBounds"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpGaugeDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsDouble     float64        `json:"asDouble"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpGaugeDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Unit        string         `json:"unit"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// attributes provides the given attribute names and values, leading with the
+// given application unless it is empty.
+func attributes(application string, pairs ...string) []otlpKeyValue {
+	var result []otlpKeyValue
+	if application != "" {
+		result = append(result, otlpKeyValue{"application", otlpAnyValue{application}})
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result = append(result, otlpKeyValue{pairs[i], otlpAnyValue{pairs[i+1]}})
+	}
+	return result
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// randomID provides a random ID of the given number of bytes.
+func randomID(size int) []byte {
+	id := make([]byte, size)
+	_, err := rand.Read(id)
+	if err != nil {
+		log.Printf("monitor: could not generate a trace ID: %v\n", err)
+	}
+	return id
+}
+
+// parseTraceParent provides the trace ID and parent span ID held by the given
+// W3C traceparent (e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"), and whether the
+// parent was sampled.
+func parseTraceParent(traceParent string) (string, string, bool, error) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, fmt.Errorf("malformed traceparent \"%v\"", traceParent)
+	}
+	for i, size := range []int{2, 32, 16, 2} {
+		_, err := hex.DecodeString(parts[i])
+		if err != nil || len(parts[i]) != size || strings.ToLower(parts[i]) != parts[i] {
+			return "", "", false, fmt.Errorf("malformed traceparent \"%v\"", traceParent)
+		}
+	}
+	if parts[0] == "ff" || strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false, fmt.Errorf("invalid traceparent \"%v\"", traceParent)
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, nil
+}
+
+// parseOTLPHeaders parses a comma-separated list of <name>=<value> headers.
+func parseOTLPHeaders(list string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, header := range strings.Split(list, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("could not parse header \"%v\"", header)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// An otlpExporter represents the connection of an OTLPMonitor (and of the
+// monitors it provides for each application) to an OTLP collector, along with
+// the metrics it exports.
+// Spans are queued without blocking and exported by a single goroutine in
+// batches of up to otlpBatchSize spans; traces that do not fit in the queue
+// are dropped and counted.
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	resource    otlpResource
+	sampleRatio float64
+	interval    time.Duration
+	client      *http.Client
+	started     time.Time
+	queue       chan []otlpSpan
+	dropped     uint64
+	metrics     *metricStore
+	// mutex guards ch, which is nil once closed
+	mutex *sync.Mutex
+	ch    chan chan interface{}
+}
+
+// run exports queued spans, and every metric once per interval, until the
+// exporter is closed through the given channel.
+func (exporter *otlpExporter) run(ch chan chan interface{}) {
+	tick := time.NewTicker(exporter.interval)
+	defer tick.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case spans := <-exporter.queue:
+			batch = append(batch, spans...)
+			if len(batch) >= otlpBatchSize {
+				exporter.exportSpans(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			exporter.exportSpans(batch)
+			batch = nil
+			exporter.exportMetrics()
+		case done := <-ch:
+			for len(exporter.queue) > 0 {
+				batch = append(batch, <-exporter.queue...)
+			}
+			exporter.exportSpans(batch)
+			exporter.exportMetrics()
+			close(done)
+			return
+		}
+	}
+}
+
+// exportSpans sends the given spans to the collector in batches.
+func (exporter *otlpExporter) exportSpans(spans []otlpSpan) {
+	for len(spans) > 0 {
+		size := len(spans)
+		if size > otlpBatchSize {
+			size = otlpBatchSize
+		}
+		exporter.post("/v1/traces", otlpTraces{
+			ResourceSpans: []otlpResourceSpans{{
+				Resource: exporter.resource,
+				ScopeSpans: []otlpScopeSpans{{
+					Scope: otlpScope{"maxwells-daemon"},
+					Spans: spans[:size],
+				}},
+			}},
+		})
+		spans = spans[size:]
+	}
+}
+
+// exportMetrics sends the current value of every metric to the collector.
+func (exporter *otlpExporter) exportMetrics() {
+	start := unixNano(exporter.started)
+	now := unixNano(time.Now())
+	sum := func(name string, unit string, description string) *otlpMetric {
+		return &otlpMetric{
+			Name:        name,
+			Description: description,
+			Unit:        unit,
+			Sum: &otlpSum{
+				AggregationTemporality: otlpCumulative,
+				IsMonotonic:            true,
+			},
+		}
+	}
+	point := func(metric *otlpMetric, value uint64, attributes []otlpKeyValue) {
+		metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsInt:             strconv.FormatUint(value, 10),
+		})
+	}
+
+	serves := sum("maxwellsdaemon.server.requests", "{request}", "Requests served.")
+	handlings := sum("maxwellsdaemon.handler.requests", "{request}", "Assignments handled, by resulting location.")
+	rolloutUpdates := sum("maxwellsdaemon.rollout.updates", "{update}", "Rollout values read from the rollout backend.")
+	rollbacks := sum("maxwellsdaemon.guard.rollbacks", "{rollback}", "Versions forced to 0 by the guard, by version.")
+	dropped := sum("maxwellsdaemon.monitor.dropped", "{trace}", "Request traces dropped because the export queue was full.")
+	gauge := func(name string, unit string, description string) *otlpMetric {
+		return &otlpMetric{
+			Name:        name,
+			Description: description,
+			Unit:        unit,
+			Gauge:       &otlpGauge{},
+		}
+	}
+	versionGauge := func(metric *otlpMetric, values map[[2]string]float64) {
+		var keys [][2]string
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sortPairs(keys)
+		for _, key := range keys {
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpGaugeDataPoint{
+				Attributes:   attributes(key[0], "version", key[1]),
+				TimeUnixNano: now,
+				AsDouble:     values[key],
+			})
+		}
+	}
+	values := gauge("maxwellsdaemon.rollout.value", "1", "Rollout value each version is served at.")
+	staleness := gauge("maxwellsdaemon.rollout.staleness", "s", "Time since each version was last read successfully.")
+	unhealthy := gauge("maxwellsdaemon.rollout.unhealthy", "1", "Whether each version has gone stale (1) or not (0).")
+	maintenance := gauge("maxwellsdaemon.maintenance", "1", "Whether maintenance mode was last turned on (1) or off (0).")
+	histogram := otlpHistogramDataPoint{
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		ExplicitBounds:    servingTimeBuckets,
+	}
+
+	store := exporter.metrics
+	store.mutex.Lock()
+	for _, result := range []string{"success", "failure"} {
+		point(serves, store.serves[result], attributes("", "result", result))
+	}
+	for _, key := range store.handlingKeys() {
+		point(handlings, store.handlings[key], attributes(key[0], "location", key[1], "result", key[2]))
+	}
+	for _, pair := range []struct {
+		metric *otlpMetric
+		counts map[[2]string]uint64
+		label  string
+	}{{rolloutUpdates, store.rolloutUpdates, "result"}, {rollbacks, store.rollbacks, "version"}} {
+		var keys [][2]string
+		for key := range pair.counts {
+			keys = append(keys, key)
+		}
+		sortPairs(keys)
+		for _, key := range keys {
+			point(pair.metric, pair.counts[key], attributes(key[0], pair.label, key[1]))
+		}
+	}
+	for _, count := range store.bucketCounts {
+		histogram.BucketCounts = append(histogram.BucketCounts, strconv.FormatUint(count, 10))
+	}
+	histogram.Count = strconv.FormatUint(store.servingCount, 10)
+	histogram.Sum = store.servingSum
+	versionGauge(values, store.values)
+	versionGauge(staleness, store.staleness)
+	// every version read from the rollout backend has reported its staleness
+	unhealthyValues := make(map[[2]string]float64, len(store.staleness))
+	for key := range store.staleness {
+		unhealthyValues[key] = float64(boolValue(store.unhealthy[key]))
+	}
+	versionGauge(unhealthy, unhealthyValues)
+	var applications []string
+	for application := range store.maintenance {
+		applications = append(applications, application)
+	}
+	sort.Strings(applications)
+	for _, application := range applications {
+		maintenance.Gauge.DataPoints = append(maintenance.Gauge.DataPoints, otlpGaugeDataPoint{
+			Attributes:   attributes(application),
+			TimeUnixNano: now,
+			AsDouble:     float64(boolValue(store.maintenance[application])),
+		})
+	}
+	store.mutex.Unlock()
+	point(dropped, atomic.LoadUint64(&exporter.dropped), nil)
+
+	metrics := []otlpMetric{*serves, {
+		Name:        "maxwellsdaemon.server.duration",
+		Description: "Time spent serving a request.",
+		Unit:        "s",
+		Histogram: &otlpHistogram{
+			DataPoints:             []otlpHistogramDataPoint{histogram},
+			AggregationTemporality: otlpCumulative,
+		},
+	}, *dropped}
+	// metrics without any data point yet are left out
+	for _, metric := range []*otlpMetric{handlings, rolloutUpdates, rollbacks} {
+		if len(metric.Sum.DataPoints) > 0 {
+			metrics = append(metrics, *metric)
+		}
+	}
+	for _, metric := range []*otlpMetric{values, staleness, unhealthy, maintenance} {
+		if len(metric.Gauge.DataPoints) > 0 {
+			metrics = append(metrics, *metric)
+		}
+	}
+	exporter.post("/v1/metrics", otlpMetrics{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: exporter.resource,
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{"maxwells-daemon"},
+				Metrics: metrics,
+			}},
+		}},
+	})
+}
+
+// post sends the given data to the given path of the collector.
+func (exporter *otlpExporter) post(path string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("monitor: could not encode OTLP data: %v\n", err)
+		return
+	}
+	request, err := http.NewRequest("POST", exporter.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("monitor: could not create OTLP request: %v\n", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range exporter.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := exporter.client.Do(request)
+	if err != nil {
+		log.Printf("monitor: could not export to the OTLP collector: %v\n", err)
+		return
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		log.Printf("monitor: OTLP collector rejected %v: %v\n", path, response.Status)
+	}
+}
+
+// An OTLPMonitor represents a monitor that exports metrics and request traces
+// to an OpenTelemetry collector using OTLP/HTTP with JSON encoding.
+// Each request served by the unix and tcp servers is traced as a span with a
+// child span for each phase of serving it (accept, read, handle and write).
+// A structured request that gives a traceparent is traced within that trace,
+// if it is sampled; other requests are sampled at the monitor's sample ratio.
+type OTLPMonitor struct {
+	metricRecorder
+	exporter *otlpExporter
+	root     bool
+}
+
+// NewOTLPMonitor creates a monitor exporting to the OTLP/HTTP collector at
+// the given base URL (e.g. "http://localhost:4318"), sending the given headers
+// with every export.
+// Spans and metrics are described as coming from the given service, and
+// exported at the given interval (spans sooner if enough are waiting).
+// The given fraction of requests that give no traceparent is traced.
+func NewOTLPMonitor(endpoint string, headers map[string]string, serviceName string, sampleRatio float64, interval time.Duration) (*OTLPMonitor, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint \"%v\"", endpoint)
+	}
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio %v is not between 0 and 1", sampleRatio)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("export interval must be positive, got %v", interval)
+	}
+	resource := otlpResource{
+		Attributes: attributes("", "service.name", serviceName),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		resource.Attributes = append(resource.Attributes, attributes("", "host.name", hostname)...)
+	}
+	exporter := &otlpExporter{
+		endpoint:    strings.TrimRight(endpoint, "/"),
+		headers:     headers,
+		resource:    resource,
+		sampleRatio: sampleRatio,
+		interval:    interval,
+		client:      &http.Client{Timeout: interval},
+		started:     time.Now(),
+		queue:       make(chan []otlpSpan, otlpQueueSize),
+		metrics:     newMetricStore(),
+		mutex:       &sync.Mutex{},
+		ch:          make(chan chan interface{}),
+	}
+	go exporter.run(exporter.ch)
+	return &OTLPMonitor{
+		metricRecorder: metricRecorder{store: exporter.metrics},
+		exporter:       exporter,
+		root:           true,
+	}, nil
+}
+
+// Dropped provides the number of request traces dropped because the export
+// queue was full.
+func (otlpMonitor *OTLPMonitor) Dropped() uint64 {
+	return atomic.LoadUint64(&otlpMonitor.exporter.dropped)
+}
+
+// Close exports every span still queued along with the final value of every
+// metric, and stops exporting.
+// Only the monitor created by NewOTLPMonitor can be closed.
+func (otlpMonitor *OTLPMonitor) Close() error {
+	if !otlpMonitor.root {
+		return fmt.Errorf("cannot close an application's monitor")
+	}
+	exporter := otlpMonitor.exporter
+	exporter.mutex.Lock()
+	ch := exporter.ch
+	exporter.ch = nil
+	exporter.mutex.Unlock()
+	if ch == nil {
+		return fmt.Errorf("already closed")
+	}
+	done := make(chan interface{})
+	ch <- done
+	<-done
+	return nil
+}
+
+// ForApplication provides a monitor that exports through the same connection,
+// adding the attribute application="<name>" to metrics that concern an
+// application.
+func (otlpMonitor *OTLPMonitor) ForApplication(application string) Monitor {
+	return &OTLPMonitor{
+		metricRecorder: metricRecorder{store: otlpMonitor.store, application: application},
+		exporter:       otlpMonitor.exporter,
+	}
+}
+
+// TraceRequest queues the spans of the given request for export if it is
+// sampled.
+func (otlpMonitor *OTLPMonitor) TraceRequest(trace *RequestTrace) {
+	exporter := otlpMonitor.exporter
+	var traceID, parentID string
+	var sampled bool
+	if trace.Parent != "" {
+		var err error
+		traceID, parentID, sampled, err = parseTraceParent(trace.Parent)
+		if err != nil {
+			// an invalid parent starts a new trace
+			traceID, parentID = "", ""
+		}
+	}
+	if traceID == "" {
+		id := randomID(16)
+		traceID = hex.EncodeToString(id)
+		// sample consistently with other services given the trace ID
+		sampled = binary.BigEndian.Uint64(id[8:])>>1 < uint64(exporter.sampleRatio*(1<<63))
+	}
+	if !sampled {
+		return
+	}
+
+	format := "line"
+	if trace.Structured {
+		format = "structured"
+	}
+	start := trace.Started
+	if !trace.Accepted.IsZero() {
+		start = trace.Accepted
+	}
+	root := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            hex.EncodeToString(randomID(8)),
+		ParentSpanID:      parentID,
+		Name:              "request",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: unixNano(start),
+		EndTimeUnixNano:   unixNano(trace.Ended),
+		Attributes:        attributes("", "network.transport", trace.Network, "maxwellsdaemon.request.format", format),
+	}
+	if trace.Err != nil {
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: trace.Err.Error()}
+	}
+	spans := []otlpSpan{root}
+	for _, phase := range []struct {
+		name  string
+		start time.Time
+		end   time.Time
+	}{
+		{"accept", trace.Accepted, trace.Started},
+		{"read", trace.Started, trace.Read},
+		{"handle", trace.Read, trace.Handled},
+		{"write", trace.Handled, trace.Written},
+	} {
+		if phase.start.IsZero() {
+			continue
+		}
+		span := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            hex.EncodeToString(randomID(8)),
+			ParentSpanID:      root.SpanID,
+			Name:              phase.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: unixNano(phase.start),
+			EndTimeUnixNano:   unixNano(phase.end),
+		}
+		if phase.end.IsZero() {
+			// serving the request failed during this phase
+			span.EndTimeUnixNano = root.EndTimeUnixNano
+			span.Status = root.Status
+		}
+		spans = append(spans, span)
+	}
+	select {
+	case exporter.queue <- spans:
+	default:
+		atomic.AddUint64(&exporter.dropped, 1)
+	}
+}
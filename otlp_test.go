@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An otlpCollector collects what is exported to it over OTLP/HTTP.
+type otlpCollector struct {
+	mutex   *sync.Mutex
+	spans   []otlpSpan
+	metrics map[string]otlpMetric
+	headers http.Header
+}
+
+func (collector *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.headers = r.Header
+	decoder := json.NewDecoder(r.Body)
+	switch r.URL.Path {
+	case "/v1/traces":
+		var traces otlpTraces
+		if err := decoder.Decode(&traces); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, resourceSpans := range traces.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+	case "/v1/metrics":
+		var metrics otlpMetrics
+		if err := decoder.Decode(&metrics); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, metric := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			collector.metrics[metric.Name] = metric
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestOTLPMonitor(t *testing.T) {
+	collector := &otlpCollector{
+		mutex:   &sync.Mutex{},
+		metrics: make(map[string]otlpMetric),
+	}
+	endpoint := httptest.NewServer(collector)
+	defer endpoint.Close()
+	// only requests within a sampled trace are traced
+	monitor, err := NewOTLPMonitor(endpoint.URL, map[string]string{"x-api-key": "secret"}, "maxwells-daemon", 0, time.Minute)
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "maxwells-daemon.sock")
+	handler := NewCanaryHandler(monitor.ForApplication("website"), NewConstantRollout(1))
+	server, err := NewUnixServer(monitor, handler, filename, 0666, -1, -1, time.Minute)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	connection, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	connection.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(connection)
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, request := range []string{
+		"{\"v\": 2, \"assignment\": \"0.5\", \"traceparent\": \"00-" + traceID + "-00f067aa0ba902b7-01\"}",
+		"{\"v\": 2, \"assignment\": \"0.5\", \"traceparent\": \"00-" + traceID + "-00f067aa0ba902b7-00\"}",
+		"{\"v\": 2, \"assignment\": \"0.5\"}",
+	} {
+		fmt.Fprintf(connection, "%v\n", request)
+		_, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+	}
+	connection.Close()
+	server.Close()
+	monitor.ForApplication("website").RecordRolloutValue("canary", 0.25)
+	monitor.ForApplication("website").RecordStaleness("canary", time.Second)
+	monitor.RecordMaintenance(true)
+	err = monitor.Close()
+	if err != nil {
+		t.Fatalf("error closing monitor: %v", err)
+	}
+	if monitor.Close() == nil {
+		t.Fatalf("monitor was able to be doubly-closed")
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	if collector.headers.Get("X-Api-Key") != "secret" {
+		t.Fatalf("expected the configured headers, got %v", collector.headers)
+	}
+	if len(collector.spans) != 5 {
+		t.Fatalf("expected the 5 spans of one request, got %+v", collector.spans)
+	}
+	root := collector.spans[0]
+	if root.Name != "request" || root.TraceID != traceID || root.ParentSpanID != "00f067aa0ba902b7" || root.Kind != otlpSpanKindServer {
+		t.Fatalf("unexpected request span %+v", root)
+	}
+	for i, name := range []string{"accept", "read", "handle", "write"} {
+		span := collector.spans[i+1]
+		if span.Name != name || span.TraceID != traceID || span.ParentSpanID != root.SpanID || span.Status != nil {
+			t.Fatalf("unexpected %v span %+v", name, span)
+		}
+		start, _ := strconv.ParseInt(span.StartTimeUnixNano, 10, 64)
+		end, _ := strconv.ParseInt(span.EndTimeUnixNano, 10, 64)
+		if start == 0 || end < start {
+			t.Fatalf("%v span has invalid times: %+v", name, span)
+		}
+	}
+
+	serves := collector.metrics["maxwellsdaemon.server.requests"].Sum
+	if serves == nil || serves.DataPoints[0].AsInt != "3" || serves.DataPoints[1].AsInt != "0" {
+		t.Fatalf("expected 3 successful serves, got %+v", serves)
+	}
+	duration := collector.metrics["maxwellsdaemon.server.duration"].Histogram
+	if duration == nil || duration.DataPoints[0].Count != "3" || len(duration.DataPoints[0].BucketCounts) != len(servingTimeBuckets)+1 {
+		t.Fatalf("expected 3 serving times, got %+v", duration)
+	}
+	handlings := collector.metrics["maxwellsdaemon.handler.requests"].Sum
+	if handlings == nil || len(handlings.DataPoints) != 1 || handlings.DataPoints[0].AsInt != "3" {
+		t.Fatalf("expected 3 handlings, got %+v", handlings)
+	}
+	expected := attributes("website", "location", "canary", "result", "success")
+	if fmt.Sprint(handlings.DataPoints[0].Attributes) != fmt.Sprint(expected) {
+		t.Fatalf("expected attributes %v, got %v", expected, handlings.DataPoints[0].Attributes)
+	}
+	for name, value := range map[string]float64{
+		"maxwellsdaemon.rollout.value":     0.25,
+		"maxwellsdaemon.rollout.staleness": 1,
+		"maxwellsdaemon.rollout.unhealthy": 0,
+		"maxwellsdaemon.maintenance":       1,
+	} {
+		gauge := collector.metrics[name].Gauge
+		if gauge == nil || len(gauge.DataPoints) != 1 || gauge.DataPoints[0].AsDouble != value {
+			t.Fatalf("expected %v to be %v, got %+v", name, value, gauge)
+		}
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, parentID, sampled, err := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID != "00f067aa0ba902b7" || !sampled {
+		t.Fatalf("unexpected result %v, %v, %v, %v", traceID, parentID, sampled, err)
+	}
+	_, _, sampled, err = parseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	if err != nil || sampled {
+		t.Fatalf("expected a later version to be accepted, got %v, %v", sampled, err)
+	}
+	for _, traceParent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, _, _, err := parseTraceParent(traceParent)
+		if err == nil {
+			t.Errorf("expected an error parsing \"%v\"", traceParent)
+		}
+	}
+}
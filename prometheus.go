@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A PrometheusMonitor represents a monitor that exposes metrics in the
+// Prometheus text format under the namespace "maxwellsdaemon_".
+// Metrics are served over HTTP at "/metrics".
+type PrometheusMonitor struct {
+	metricRecorder
+	// rollouts holds the rollout observed for each application ("" if
+	// none), and is shared with the monitors provided for each application
+	// and guarded by the store's mutex
+	rollouts map[string]Rollout
+	listener net.Listener
+}
+
+// NewPrometheusMonitor creates a monitor that serves metrics over HTTP on the
+// given address (e.g. ":9315").
+func NewPrometheusMonitor(address string) (*PrometheusMonitor, error) {
+	listener, err := listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error creating metrics listener \"%v\": %v", address, err)
+	}
+	prometheusMonitor := &PrometheusMonitor{
+		metricRecorder: metricRecorder{store: newMetricStore()},
+		rollouts:       make(map[string]Rollout),
+		listener:       listener,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheusMonitor)
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			log.Printf("monitor: metrics listener stopped: %v\n", err)
+		}
+	}()
+	return prometheusMonitor, nil
+}
+
+// Close stops serving metrics.
+// Monitors provided for an application do not serve metrics themselves, and
+// cannot be closed.
+func (prometheusMonitor *PrometheusMonitor) Close() error {
+	if prometheusMonitor.listener == nil {
+		return fmt.Errorf("monitor does not serve metrics")
+	}
+	return prometheusMonitor.listener.Close()
+}
+
+// ForApplication provides a monitor that records to the same metrics, adding
+// the label application="<name>" to metrics that concern an application.
+func (prometheusMonitor *PrometheusMonitor) ForApplication(application string) Monitor {
+	return &PrometheusMonitor{
+		metricRecorder: metricRecorder{store: prometheusMonitor.store, application: application},
+		rollouts:       prometheusMonitor.rollouts,
+	}
+}
+
+// ObserveRollout exports the values of the given rollout as gauges.
+func (prometheusMonitor *PrometheusMonitor) ObserveRollout(rollout Rollout) {
+	prometheusMonitor.store.mutex.Lock()
+	prometheusMonitor.rollouts[prometheusMonitor.application] = rollout
+	prometheusMonitor.store.mutex.Unlock()
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(buffer *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buffer, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeResultCounter(buffer *bytes.Buffer, name string, help string, counts map[string]uint64) {
+	writeHeader(buffer, name, "counter", help)
+	for _, key := range []string{"success", "failure"} {
+		fmt.Fprintf(buffer, "%v{result=\"%v\"} %v\n", name, key, counts[key])
+	}
+}
+
+// formatLabels formats the given label names and values, leading with the
+// given application unless it is empty (no labels at all format as nothing).
+func formatLabels(application string, pairs ...string) string {
+	var labels []string
+	if application != "" {
+		labels = append(labels, fmt.Sprintf("application=\"%v\"", escapeLabel(application)))
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%v=\"%v\"", pairs[i], escapeLabel(pairs[i+1])))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (prometheusMonitor *PrometheusMonitor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var buffer bytes.Buffer
+	store := prometheusMonitor.store
+	store.mutex.Lock()
+	writeResultCounter(&buffer, "maxwellsdaemon_server_requests_total", "Connections served.", store.serves)
+
+	writeHeader(&buffer, "maxwellsdaemon_server_serving_seconds", "histogram", "Time spent serving a connection.")
+	// Prometheus buckets also count the serving times of lower buckets
+	var cumulative uint64
+	for i, upper := range servingTimeBuckets {
+		cumulative += store.bucketCounts[i]
+		fmt.Fprintf(&buffer, "maxwellsdaemon_server_serving_seconds_bucket{le=\"%v\"} %v\n", formatValue(upper), cumulative)
+	}
+	fmt.Fprintf(&buffer, "maxwellsdaemon_server_serving_seconds_bucket{le=\"+Inf\"} %v\n", store.servingCount)
+	fmt.Fprintf(&buffer, "maxwellsdaemon_server_serving_seconds_sum %v\n", formatValue(store.servingSum))
+	fmt.Fprintf(&buffer, "maxwellsdaemon_server_serving_seconds_count %v\n", store.servingCount)
+
+	writeHeader(&buffer, "maxwellsdaemon_handler_requests_total", "counter", "Assignments handled, by resulting location.")
+	for _, key := range store.handlingKeys() {
+		fmt.Fprintf(&buffer, "maxwellsdaemon_handler_requests_total%v %v\n", formatLabels(key[0], "location", key[1], "result", key[2]), store.handlings[key])
+	}
+
+	writeHeader(&buffer, "maxwellsdaemon_rollout_updates_total", "counter", "Rollout values read from the rollout backend.")
+	applications := map[string]bool{}
+	for key := range store.rolloutUpdates {
+		applications[key[0]] = true
+	}
+	for application := range prometheusMonitor.rollouts {
+		applications[application] = true
+	}
+	if len(applications) == 0 {
+		applications[""] = true
+	}
+	var names []string
+	for application := range applications {
+		names = append(names, application)
+	}
+	sort.Strings(names)
+	for _, application := range names {
+		for _, result := range []string{"success", "failure"} {
+			fmt.Fprintf(&buffer, "maxwellsdaemon_rollout_updates_total%v %v\n", formatLabels(application, "result", result), store.rolloutUpdates[[2]string{application, result}])
+		}
+	}
+
+	writeHeader(&buffer, "maxwellsdaemon_guard_rollbacks_total", "counter", "Versions forced to 0 by the guard, by version.")
+	var rollbacks [][2]string
+	for key := range store.rollbacks {
+		rollbacks = append(rollbacks, key)
+	}
+	sortPairs(rollbacks)
+	for _, key := range rollbacks {
+		fmt.Fprintf(&buffer, "maxwellsdaemon_guard_rollbacks_total%v %v\n", formatLabels(key[0], "version", key[1]), store.rollbacks[key])
+	}
+
+	// every version read from the rollout backend has reported its staleness
+	if len(store.staleness) > 0 {
+		var versions [][2]string
+		for key := range store.staleness {
+			versions = append(versions, key)
+		}
+		sortPairs(versions)
+		writeHeader(&buffer, "maxwellsdaemon_rollout_staleness_seconds", "gauge", "Time since each version was last read successfully.")
+		for _, key := range versions {
+			fmt.Fprintf(&buffer, "maxwellsdaemon_rollout_staleness_seconds%v %v\n", formatLabels(key[0], "version", key[1]), formatValue(store.staleness[key]))
+		}
+		writeHeader(&buffer, "maxwellsdaemon_rollout_unhealthy", "gauge", "Whether each version has gone stale (1) or not (0).")
+		for _, key := range versions {
+			fmt.Fprintf(&buffer, "maxwellsdaemon_rollout_unhealthy%v %v\n", formatLabels(key[0], "version", key[1]), boolValue(store.unhealthy[key]))
+		}
+	}
+	if len(store.maintenance) > 0 {
+		var maintenances []string
+		for application := range store.maintenance {
+			maintenances = append(maintenances, application)
+		}
+		sort.Strings(maintenances)
+		writeHeader(&buffer, "maxwellsdaemon_maintenance", "gauge", "Whether maintenance mode was last turned on (1) or off (0).")
+		for _, application := range maintenances {
+			fmt.Fprintf(&buffer, "maxwellsdaemon_maintenance%v %v\n", formatLabels(application), boolValue(store.maintenance[application]))
+		}
+	}
+	rollouts := make(map[string]Rollout, len(prometheusMonitor.rollouts))
+	for application, rollout := range prometheusMonitor.rollouts {
+		rollouts[application] = rollout
+	}
+	store.mutex.Unlock()
+
+	if len(rollouts) > 0 {
+		writeHeader(&buffer, "maxwellsdaemon_rollout_value", "gauge", "Rollout value currently served, by version.")
+		for _, application := range names {
+			rollout, ok := rollouts[application]
+			if !ok {
+				continue
+			}
+			versions := rollout.Versions()
+			sort.Strings(versions)
+			for _, name := range versions {
+				value := 0.0
+				if valueP := rollout.Get(name); valueP != nil {
+					value = *valueP
+				}
+				fmt.Fprintf(&buffer, "maxwellsdaemon_rollout_value%v %v\n", formatLabels(application, "version", name), formatValue(value))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
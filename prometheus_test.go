@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMonitorMetrics(t *testing.T) {
+	monitor, err := NewPrometheusMonitor("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	defer monitor.Close()
+	monitor.ObserveRollout(NewConstantRollout(0.25))
+	monitor.RecordServe(nil)
+	monitor.RecordServe(fmt.Errorf("failed"))
+	monitor.RecordServe(nil)
+	monitor.RecordServingTime(2 * time.Millisecond)
+	monitor.RecordHandling("canary", nil)
+	monitor.RecordHandling("master", fmt.Errorf("failed"))
+	monitor.RecordRolloutUpdate(nil)
+	monitor.RecordStaleness("canary", 1500*time.Millisecond)
+	monitor.RecordStaleness("beta", 0)
+	monitor.RecordUnhealthy("canary", true)
+	monitor.RecordMaintenance(true)
+	recorder := httptest.NewRecorder()
+	monitor.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	expected := []string{
+		`maxwellsdaemon_server_requests_total{result="success"} 2`,
+		`maxwellsdaemon_server_requests_total{result="failure"} 1`,
+		`maxwellsdaemon_server_serving_seconds_bucket{le="0.001"} 0`,
+		`maxwellsdaemon_server_serving_seconds_bucket{le="0.0025"} 1`,
+		`maxwellsdaemon_server_serving_seconds_bucket{le="+Inf"} 1`,
+		`maxwellsdaemon_server_serving_seconds_count 1`,
+		`maxwellsdaemon_handler_requests_total{location="canary",result="success"} 1`,
+		`maxwellsdaemon_handler_requests_total{location="master",result="failure"} 1`,
+		`maxwellsdaemon_rollout_updates_total{result="success"} 1`,
+		`maxwellsdaemon_rollout_value{version="canary"} 0.25`,
+		`maxwellsdaemon_rollout_staleness_seconds{version="canary"} 1.5`,
+		`maxwellsdaemon_rollout_unhealthy{version="beta"} 0`,
+		`maxwellsdaemon_rollout_unhealthy{version="canary"} 1`,
+		`maxwellsdaemon_maintenance 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q:\n%v", line, body)
+		}
+	}
+}
+
+func TestPrometheusMonitorApplications(t *testing.T) {
+	monitor, err := NewPrometheusMonitor("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating monitor: %v", err)
+	}
+	defer monitor.Close()
+	website := monitor.ForApplication("website")
+	api := monitor.ForApplication("api")
+	website.(RolloutObserver).ObserveRollout(NewConstantRollout(0.25))
+	api.(RolloutObserver).ObserveRollout(NewConstantRollout(0.5))
+	website.RecordHandling("canary", nil)
+	api.RecordRolloutUpdate(nil)
+	api.RecordServe(nil)
+	recorder := httptest.NewRecorder()
+	monitor.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	expected := []string{
+		`maxwellsdaemon_server_requests_total{result="success"} 1`,
+		`maxwellsdaemon_handler_requests_total{application="website",location="canary",result="success"} 1`,
+		`maxwellsdaemon_rollout_updates_total{application="api",result="success"} 1`,
+		`maxwellsdaemon_rollout_updates_total{application="website",result="success"} 0`,
+		`maxwellsdaemon_rollout_value{application="api",version="canary"} 0.5`,
+		`maxwellsdaemon_rollout_value{application="website",version="canary"} 0.25`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q:\n%v", line, body)
+		}
+	}
+}
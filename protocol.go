@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// protocolVersion is the current version of the structured request format.
+const protocolVersion int = 2
+
+// A structuredRequest is a request in the structured (version 2) format of the
+// line protocol: a single line holding a JSON object, e.g.
+// {"v": 2, "application": "website", "key": "1234", "ip": "203.0.113.7", "path": "/beta", "host": "example.com"}.
+// Either an assignment or a key may be given; if neither is, a random
+// assignment is made.
+// If no application is given, the default application is used.
+// A "traceparent" (see https://www.w3.org/TR/trace-context/) places the
+// request within the client's trace for monitors that trace requests.
+type structuredRequest struct {
+	V           int               `json:"v"`
+	Application string            `json:"application"`
+	Assignment  string            `json:"assignment"`
+	Key         string            `json:"key"`
+	IP          string            `json:"ip"`
+	Path        string            `json:"path"`
+	Host        string            `json:"host"`
+	Headers     map[string]string `json:"headers"`
+	Attributes  map[string]string `json:"attributes"`
+	TraceParent string            `json:"traceparent"`
+}
+
+// A structuredResponse is the response to a structuredRequest, written as a
+// single line holding a JSON object, e.g.
+// {"v": 2, "assignment": "0.42", "location": "canary", "generation": 7, "reason": "rollout"}.
+// If the request could not be handled, only an error is given instead, and the
+// client should use master.
+type structuredResponse struct {
+	V int `json:"v"`
+	*Decision
+	Error string `json:"error,omitempty"`
+}
+
+// parseStructuredRequest parses a single structured request line.
+func parseStructuredRequest(line string) (*Request, error) {
+	var structured structuredRequest
+	err := json.Unmarshal([]byte(line), &structured)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse request: %v", err)
+	}
+	if structured.V != protocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %v", structured.V)
+	}
+	request := &Request{
+		Application: structured.Application,
+		Input:       structured.Assignment,
+		Key:         structured.Key,
+		Path:        structured.Path,
+		Host:        structured.Host,
+		Attributes:  structured.Attributes,
+		TraceParent: structured.TraceParent,
+	}
+	if request.Input == "" && request.Key != "" {
+		request.Input = keyPrefix + request.Key
+	}
+	if structured.IP != "" {
+		request.IP = net.ParseIP(structured.IP)
+		if request.IP == nil {
+			return nil, fmt.Errorf("could not parse IP \"%v\"", structured.IP)
+		}
+	}
+	if len(structured.Headers) > 0 {
+		request.Header = make(http.Header, len(structured.Headers))
+		for name, value := range structured.Headers {
+			request.Header.Set(name, value)
+		}
+	}
+	return request, nil
+}
+
+// decide provides the decision of the given handler for the given request.
+// Handlers that are not RequestHandlers are only given the request's input,
+// and must produce an assignment and location each suffixed with a newline
+// ('\n').
+func decide(handler Handler, request *Request) (Decision, error) {
+	if requestHandler, ok := handler.(RequestHandler); ok {
+		return requestHandler.Decide(request), nil
+	}
+	lines := strings.Split(handler.Handle(request.Input), "\n")
+	if len(lines) != 3 || lines[2] != "" {
+		return Decision{}, fmt.Errorf("handler did not produce an assignment and location")
+	}
+	return Decision{
+		Assignment: lines[0],
+		Location:   lines[1],
+	}, nil
+}
+
+// respondStructured handles a request parsed by parseStructuredRequest,
+// producing a single response line without its trailing newline ('\n').
+// If the request could not be parsed, the response holds the given error.
+func respondStructured(handler Handler, request *Request, err error) (string, error) {
+	response := structuredResponse{
+		V: protocolVersion,
+	}
+	if err == nil {
+		var decision Decision
+		decision, err = decide(handler, request)
+		response.Decision = &decision
+	}
+	if err != nil {
+		response.Decision = nil
+		response.Error = err.Error()
+	}
+	data, encodeErr := json.Marshal(response)
+	if encodeErr != nil {
+		return "", fmt.Errorf("could not encode response: %v", encodeErr)
+	}
+	return string(data), err
+}
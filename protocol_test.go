@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStructuredRequest(t *testing.T) {
+	request, err := parseStructuredRequest(`{"v": 2, "key": "42", "ip": "203.0.113.7", "host": "example.com", "headers": {"x-employee": "true"}, "attributes": {"plan": "pro"}, "traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`)
+	if err != nil {
+		t.Fatalf("error parsing request: %v", err)
+	}
+	if request.Input != "key:42" || request.Key != "42" || request.IP.String() != "203.0.113.7" || request.Host != "example.com" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	if request.Header.Get("X-Employee") != "true" || request.Attributes["plan"] != "pro" {
+		t.Fatalf("unexpected headers or attributes %+v", request)
+	}
+	if request.TraceParent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("unexpected traceparent %v", request.TraceParent)
+	}
+	for _, line := range []string{`{"v": 1}`, `{"v": 2, "ip": "nope"}`, `{"v": 2`} {
+		_, err := parseStructuredRequest(line)
+		if err == nil {
+			t.Errorf("expected an error parsing %v", line)
+		}
+	}
+}
+
+func TestRespondStructuredRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`[{"version": "canary", "hosts": ["Beta.Example.com"], "attributes": {"plan": "pro"}}]`))
+	if err != nil {
+		t.Fatalf("error parsing rules: %v", err)
+	}
+	handler := NewCanaryHandler(&NilMonitor{}, targetedMapRollout{mapRollout{"canary": 0}, rules})
+	request, err := parseStructuredRequest(`{"v": 2, "host": "beta.example.com:443", "attributes": {"plan": "pro"}}`)
+	result, err := respondStructured(handler, request, err)
+	if err != nil {
+		t.Fatalf("error handling request: %v", err)
+	}
+	if !strings.Contains(result, `"location":"canary"`) || !strings.Contains(result, `"reason":"rule 1"`) {
+		t.Fatalf("expected a location pinned by rule 1, got %v", result)
+	}
+}
+
+func TestRespondStructuredEcho(t *testing.T) {
+	request, err := parseStructuredRequest(`{"v": 2, "assignment": "0.5"}`)
+	result, err := respondStructured(&EchoHandler{}, request, err)
+	if err == nil || !strings.Contains(result, `"error"`) {
+		t.Fatalf("expected an error for a handler without a location, got %v, %v", result, err)
+	}
+	request, err = parseStructuredRequest(`{"v": 2, "assignment": "0.5\nmaster\n"}`)
+	result, err = respondStructured(&EchoHandler{}, request, err)
+	if err != nil || result != `{"v":2,"assignment":"0.5","location":"master","generation":0,"reason":""}` {
+		t.Fatalf("unexpected response %v, %v", result, err)
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"time"
@@ -20,12 +25,118 @@ type Rollout interface {
 	// Note that it is possible for the value to be outside of the
 	// acceptable [0.0,1.0] range - this should be checked by the caller.
 	Get(string) *float64
+	// Versions provides the names of every version currently known to the
+	// rollout (including special entries such as "maintenance"), in no
+	// particular order.
+	Versions() []string
+}
+
+// An InspectableRollout is a Rollout that can describe what it holds for every
+// version.
+type InspectableRollout interface {
+	Rollout
+	// States provides the state of every version known to the rollout.
+	States() map[string]VersionState
+}
+
+// A GenerationalRollout is a Rollout that can identify the values it holds.
+type GenerationalRollout interface {
+	Rollout
+	// Generation provides a number that increases whenever the values
+	// held by the rollout change.
+	Generation() uint64
+}
+
+// A TunableRollout is a Rollout whose polling can be adjusted while it runs.
+type TunableRollout interface {
+	Rollout
+	// Tune replaces the delay between reads of the backend and the
+	// duration after which unrefreshed values go stale.
+	Tune(delay time.Duration, unhealthy time.Duration)
+}
+
+// A VersionState describes what a rollout holds for a single version.
+type VersionState struct {
+	Percentage  float64   `json:"percentage"`
+	LastUpdated time.Time `json:"lastUpdated"`
+	IsUnhealthy bool      `json:"isUnhealthy"`
+	Schedule    string    `json:"schedule,omitempty"`
 }
 
 type version struct {
 	lastUpdated time.Time
 	isUnhealthy bool
 	percentage  float64
+	schedule    *Schedule
+	rules       []Rule
+}
+
+// A rolloutValue is the rollout of a single version as read from a backend.
+// If a schedule is set, it takes precedence over the percentage once started.
+// The "rules" entry holds targeting rules instead of a percentage.
+type rolloutValue struct {
+	percentage float64
+	schedule   *Schedule
+	rules      []Rule
+}
+
+// changed provides whether the given value differs from what the version
+// holds.
+func (val *version) changed(newValue rolloutValue) bool {
+	if val.isUnhealthy || val.percentage != newValue.percentage {
+		return true
+	}
+	if (val.schedule == nil) != (newValue.schedule == nil) {
+		return true
+	}
+	if val.schedule != nil && val.schedule.String() != newValue.schedule.String() {
+		return true
+	}
+	return !reflect.DeepEqual(val.rules, newValue.rules)
+}
+
+// current provides the rollout value of the version at the given time: the
+// current step of its schedule if one has started, otherwise its percentage.
+func (val *version) current(now time.Time) float64 {
+	if val.schedule != nil {
+		if scheduled, ok := val.schedule.At(now); ok {
+			return scheduled
+		}
+	}
+	return val.percentage
+}
+
+// step provides the number of the step of the version's schedule in effect at
+// the given time (see Schedule.Step), or 0 if it has no schedule.
+func (val *version) step(now time.Time) int {
+	if val.schedule == nil {
+		return 0
+	}
+	return val.schedule.Step(now)
+}
+
+// A versionCache holds the most recently read rollout value of every version.
+// Versions that are not refreshed within the unhealthy duration drop to 0 and
+// are reported as unavailable.
+// If a snapshot file is set, values are persisted to it as they are read, so
+// that they can be restored on startup (see restore).
+// Every update reports the value and staleness of each version, along with
+// versions going stale or recovering, to the cache's monitor.
+type versionCache struct {
+	mutex      *sync.RWMutex
+	versions   map[string]*version
+	generation uint64
+	snapshot   string
+	persisted  time.Time
+	monitor    Monitor
+}
+
+func newVersionCache(monitor Monitor) *versionCache {
+	return &versionCache{
+		mutex:    &sync.RWMutex{},
+		versions: make(map[string]*version),
+		monitor:  monitor,
+	}
 }
 
 // A DynamoDBRollout represents a rollout that is continuously fetched from
@@ -33,106 +144,217 @@ type version struct {
 // The DynamoDB table must have a hash string key of "application", a range
 // string key of "version", and a rollout number value stored under the key
 // "rollout".
-// "version" must always be set to "canary".
+// A row may also hold a ramp schedule (see ParseSchedule) as a string under
+// the key "schedule" along with its start time, in seconds since the Unix
+// epoch, as a number under the key "start".
+// Every "version" row stored for the application is discovered; the
+// "maintenance" row is reserved for maintenance mode, and the "rules" row
+// holds targeting rules (see ParseRules) as a string under the key "rules"
+// instead of a rollout value.
 // If enough calls to DynamoDB fail, the rollout value will drop to 0 to
 // minimize possible damange (i.e. the inability to rollback a canary).
 type DynamoDBRollout struct {
+	*versionCache
+	db        *dynamodb.DynamoDB
+	table     string
+	poller    *DynamoDBPoller
+	unhealthy time.Duration
+	load      func() map[string]rolloutValue
+}
+
+// A DynamoDBPoller represents a single loop that queries a DynamoDB table for
+// the rollout values of several applications in turn.
+// Every version of an application is discovered with a query on its hash key;
+// DynamoDB cannot batch queries (BatchGetItem needs the full key, and so every
+// version, in advance), so one query is made per application in each round.
+type DynamoDBPoller struct {
 	db       *dynamodb.DynamoDB
 	table    string
-	mutex    *sync.RWMutex
-	versions map[string]*version
+	delay    time.Duration
+	mutex    *sync.Mutex
+	rollouts []*DynamoDBRollout
+	started  bool
 }
 
-func (r *DynamoDBRollout) update(unhealthy time.Duration, updates map[string]float64) {
+func (r *versionCache) update(unhealthy time.Duration, updates map[string]rolloutValue) {
 	if updates == nil {
-		updates = make(map[string]float64)
+		updates = make(map[string]rolloutValue)
 	}
 	r.mutex.Lock()
+	now := time.Now()
+	changed := false
+	// versions that went stale (true) or recovered (false)
+	transitions := make(map[string]bool)
 	// update existing entries
 	for key, val := range r.versions {
-		newPercentage, ok := updates[key]
+		newValue, ok := updates[key]
 		if !ok {
 			if time.Since(val.lastUpdated) > unhealthy {
-				if !val.isUnhealthy && val.percentage > 0 {
+				if !val.isUnhealthy && (val.percentage > 0 || val.schedule != nil || val.rules != nil) {
 					log.Printf("rollout: \"%v\" contains stale data", key)
 				}
+				if !val.isUnhealthy {
+					changed = true
+					transitions[key] = true
+				}
+				// keep the steps its schedule counted towards the generation
+				r.generation += uint64(val.step(now))
 				val.percentage = 0
+				val.schedule = nil
+				val.rules = nil
 				val.isUnhealthy = true
 			}
 		} else {
+			if val.changed(newValue) {
+				changed = true
+				r.generation += uint64(val.step(now))
+			}
+			if val.isUnhealthy {
+				transitions[key] = false
+			}
 			val.lastUpdated = time.Now()
 			val.isUnhealthy = false
-			val.percentage = newPercentage
+			val.percentage = newValue.percentage
+			val.schedule = newValue.schedule
+			val.rules = newValue.rules
 		}
 	}
 	// add missing entries
 	for key, val := range updates {
 		_, ok := r.versions[key]
 		if !ok {
+			changed = true
 			r.versions[key] = &version{
 				lastUpdated: time.Now(),
 				isUnhealthy: false,
-				percentage:  val,
+				percentage:  val.percentage,
+				schedule:    val.schedule,
+				rules:       val.rules,
 			}
 		}
 	}
+	if changed {
+		r.generation++
+	}
+	values := make(map[string]float64, len(r.versions))
+	staleness := make(map[string]time.Duration, len(r.versions))
+	for key, val := range r.versions {
+		if key != rulesVersion {
+			values[key] = val.current(now)
+		}
+		staleness[key] = now.Sub(val.lastUpdated)
+	}
 	r.mutex.Unlock()
+	for key, unhealthy := range transitions {
+		r.monitor.RecordUnhealthy(key, unhealthy)
+	}
+	for key, value := range values {
+		r.monitor.RecordRolloutValue(key, value)
+	}
+	for key, duration := range staleness {
+		r.monitor.RecordStaleness(key, duration)
+	}
+	// refresh the snapshot's timestamp often enough that it is not stale when
+	// restored
+	if r.snapshot != "" && len(updates) > 0 && (changed || time.Since(r.persisted) > unhealthy/2) {
+		err := r.persist(updates)
+		if err != nil {
+			log.Printf("rollout: could not persist snapshot: %v", err)
+		}
+	}
 }
 
 // NewDynamoDBRollout creates a new DynamoDBRollout and begins eternally
-// querying the given DynamoDB table in the given region for canary values for
-// the given application.
+// querying the given DynamoDB table in the given region for the rollout values
+// of every version of the given application.
 // Queries to DynamoDB are interspersed with the given delay to avoid using up
 // all the read capacity.
 // If calls to DynamoDB fail / are unhealthy for the specified amount of time,
 // rollout will be dropped 0.0.
-func NewDynamoDBRollout(monitor Monitor, db *dynamodb.DynamoDB, table string, application string, delay time.Duration, unhealthy time.Duration) (*DynamoDBRollout, error) {
-	const hashField string = "application"
-	const rangeField string = "version"
-	const rolloutField string = "rollout"
-	// []strings are not constants
-	rangeKeys := []string{
-		"maintenance",
-		"canary",
+// If a snapshot file is given, the last values read are persisted to it and
+// restored from it on startup, as long as they were read within the unhealthy
+// duration; this way a restart while DynamoDB is unreachable keeps serving
+// the last known good values until they would have gone stale anyway.
+func NewDynamoDBRollout(monitor Monitor, db *dynamodb.DynamoDB, table string, application string, delay time.Duration, unhealthy time.Duration, snapshot string) (*DynamoDBRollout, error) {
+	poller, err := NewDynamoDBPoller(db, table, delay)
+	if err != nil {
+		return nil, err
 	}
+	return poller.Add(monitor, application, unhealthy, snapshot), nil
+}
 
+// NewDynamoDBPoller creates a poller for the given DynamoDB table that waits
+// for the given delay between rounds of queries.
+// Nothing is queried until an application is added.
+func NewDynamoDBPoller(db *dynamodb.DynamoDB, table string, delay time.Duration) (*DynamoDBPoller, error) {
 	if db == nil {
 		return nil, fmt.Errorf("dynamo.DynamoDB argument is nil")
 	}
+	return &DynamoDBPoller{
+		db:    db,
+		table: table,
+		delay: delay,
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+// Add creates a DynamoDBRollout holding the rollout values of every version of
+// the given application, queried in every round from now on (beginning the
+// poller's loop if needed).
+// The unhealthy duration and snapshot file behave exactly as with
+// NewDynamoDBRollout.
+func (poller *DynamoDBPoller) Add(monitor Monitor, application string, unhealthy time.Duration, snapshot string) *DynamoDBRollout {
+	const hashField string = "application"
+	const rangeField string = "version"
+	const rolloutField string = "rollout"
+	const scheduleField string = "schedule"
+	const startField string = "start"
+	const rulesField string = "rules"
+
+	db := poller.db
+	table := poller.table
 	dynamodbRollout := &DynamoDBRollout{
-		db:       db,
-		table:    table,
-		mutex:    &sync.RWMutex{},
-		versions: make(map[string]*version),
+		versionCache: newVersionCache(monitor),
+		db:           db,
+		table:        table,
+		poller:       poller,
+		unhealthy:    unhealthy,
 	}
-	var keys []map[string]*dynamodb.AttributeValue
-	for _, key := range rangeKeys {
-		keys = append(keys, map[string]*dynamodb.AttributeValue{
-			hashField:  {S: aws.String(application)},
-			rangeField: {S: aws.String(key)},
-		})
+	if snapshot != "" {
+		dynamodbRollout.snapshot = snapshot
+		err := dynamodbRollout.restore(unhealthy)
+		if err != nil {
+			log.Printf("rollout: not restoring snapshot: %v", err)
+		}
 	}
-	batchGetItemInput := &dynamodb.BatchGetItemInput{
-		RequestItems: map[string]*dynamodb.KeysAndAttributes{
-			table: &dynamodb.KeysAndAttributes{
-				ProjectionExpression: aws.String(fmt.Sprintf("%v, %v", rangeField, rolloutField)),
-				ConsistentRead:       aws.Bool(true),
-				Keys:                 keys,
-			},
+	queryInput := &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("#application = :application"),
+		ProjectionExpression:   aws.String("#version, #rollout, #schedule, #start, #rules"),
+		ExpressionAttributeNames: map[string]*string{
+			"#application": aws.String(hashField),
+			"#version":     aws.String(rangeField),
+			"#rollout":     aws.String(rolloutField),
+			"#schedule":    aws.String(scheduleField),
+			"#start":       aws.String(startField),
+			"#rules":       aws.String(rulesField),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":application": {S: aws.String(application)},
 		},
 	}
-	loadRollouts := func() map[string]float64 {
-		batchGetItemOutput, err := db.BatchGetItem(batchGetItemInput)
+	loadRollouts := func() map[string]rolloutValue {
+		var tableItems []map[string]*dynamodb.AttributeValue
+		err := db.QueryPages(queryInput, func(page *dynamodb.QueryOutput, _ bool) bool {
+			tableItems = append(tableItems, page.Items...)
+			return true
+		})
 		if err != nil {
-			log.Printf("could not fetch rollout values: %v", err)
-			return nil
-		}
-		tableItems, ok := batchGetItemOutput.Responses[table]
-		if !ok {
-			log.Printf("could not find rollout values in response")
+			log.Printf("could not fetch rollout values of \"%v\": %v", application, err)
 			return nil
 		}
-		results := make(map[string]float64)
+		results := make(map[string]rolloutValue)
 		loadRollout := func(item map[string]*dynamodb.AttributeValue) error {
 			nameRaw, ok := item[rangeField]
 			if !ok {
@@ -145,6 +367,20 @@ func NewDynamoDBRollout(monitor Monitor, db *dynamodb.DynamoDB, table string, ap
 			if *name == "" {
 				return fmt.Errorf("release name is empty string")
 			}
+			if *name == rulesVersion {
+				rulesRaw := item[rulesField]
+				if rulesRaw == nil || rulesRaw.S == nil {
+					return fmt.Errorf("rules are not stored as a string type")
+				}
+				rules, err := ParseRules([]byte(*rulesRaw.S))
+				if err != nil {
+					return err
+				}
+				results[*name] = rolloutValue{
+					rules: rules,
+				}
+				return nil
+			}
 			percentageRaw := item[rolloutField]
 			if percentageRaw == nil {
 				return fmt.Errorf("could not find \"%s\" key in response", rolloutField)
@@ -160,7 +396,28 @@ func NewDynamoDBRollout(monitor Monitor, db *dynamodb.DynamoDB, table string, ap
 			if percentage < 0 || percentage > 1 {
 				return fmt.Errorf("rollout value is out of [0.0,1.0] range")
 			}
-			results[*name] = percentage
+			value := rolloutValue{
+				percentage: percentage,
+			}
+			scheduleRaw := item[scheduleField]
+			if scheduleRaw != nil {
+				if scheduleRaw.S == nil {
+					return fmt.Errorf("schedule is not stored as a string type")
+				}
+				startRaw := item[startField]
+				if startRaw == nil || startRaw.N == nil {
+					return fmt.Errorf("schedule start is not stored as a number type")
+				}
+				start, err := strconv.ParseFloat(*startRaw.N, 64)
+				if err != nil {
+					return fmt.Errorf("could not parse schedule start as a number: %v", err)
+				}
+				value.schedule, err = ParseSchedule(*scheduleRaw.S, unixSeconds(start))
+				if err != nil {
+					return fmt.Errorf("could not parse schedule: %v", err)
+				}
+			}
+			results[*name] = value
 			return nil
 		}
 		for _, item := range tableItems {
@@ -172,19 +429,57 @@ func NewDynamoDBRollout(monitor Monitor, db *dynamodb.DynamoDB, table string, ap
 		}
 		return results
 	}
-	go func() {
-		for {
-			updates := loadRollouts()
+	dynamodbRollout.load = loadRollouts
+	poller.mutex.Lock()
+	poller.rollouts = append(poller.rollouts, dynamodbRollout)
+	start := !poller.started
+	poller.started = true
+	poller.mutex.Unlock()
+	if start {
+		go poller.poll()
+	}
+	return dynamodbRollout
+}
+
+// poll eternally queries for every application in turn.
+func (poller *DynamoDBPoller) poll() {
+	for {
+		poller.mutex.Lock()
+		rollouts := append([]*DynamoDBRollout(nil), poller.rollouts...)
+		delay := poller.delay
+		poller.mutex.Unlock()
+		for _, dynamodbRollout := range rollouts {
+			updates := dynamodbRollout.load()
+			dynamodbRollout.mutex.RLock()
+			unhealthy := dynamodbRollout.unhealthy
+			dynamodbRollout.mutex.RUnlock()
 			dynamodbRollout.update(unhealthy, updates)
-			time.Sleep(delay)
 		}
-	}()
-	return dynamodbRollout, nil
+		time.Sleep(delay)
+	}
 }
 
-// Get provides the most recently read rollout value from DynamoDB.
+// SetDelay replaces the delay between rounds of queries, from the next round
+// on.
+func (poller *DynamoDBPoller) SetDelay(delay time.Duration) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	poller.delay = delay
+}
+
+// Tune replaces the delay between queries (of every application sharing the
+// rollout's poller) and the unhealthy duration, from the next query on.
+func (dynamodbRollout *DynamoDBRollout) Tune(delay time.Duration, unhealthy time.Duration) {
+	dynamodbRollout.poller.SetDelay(delay)
+	dynamodbRollout.mutex.Lock()
+	defer dynamodbRollout.mutex.Unlock()
+	dynamodbRollout.unhealthy = unhealthy
+}
+
+// Get provides the most recently read rollout value, or the current step of
+// its schedule if one has started.
 // The return value may be outside of the [0.0,1.0] range.
-func (r *DynamoDBRollout) Get(name string) *float64 {
+func (r *versionCache) Get(name string) *float64 {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	version, ok := r.versions[name]
@@ -195,10 +490,320 @@ func (r *DynamoDBRollout) Get(name string) *float64 {
 	if version.isUnhealthy {
 		return nil
 	}
-	return &version.percentage
+	percentage := version.current(time.Now())
+	return &percentage
+}
+
+// Versions provides the names of every version that has been read, including
+// those that have since gone stale.
+func (r *versionCache) Versions() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	names := make([]string, 0, len(r.versions))
+	for name := range r.versions {
+		names = append(names, name)
+	}
+	return names
 }
 
-// A ConstantRollout represents a rollout that will always have the same value.
+// Generation provides a number that increases whenever a version is added,
+// changes value, goes stale, or its schedule advances to its next step.
+func (r *versionCache) Generation() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	// the steps of current schedules are counted on top of the changes
+	// read, and are added to the latter when a schedule is replaced, so
+	// that the sum never decreases
+	generation := r.generation
+	now := time.Now()
+	for _, val := range r.versions {
+		generation += uint64(val.step(now))
+	}
+	return generation
+}
+
+// Rules provides the most recently read targeting rules, or nil if there are
+// none or they have gone stale.
+func (r *versionCache) Rules() []Rule {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	version, ok := r.versions[rulesVersion]
+	if !ok || version.isUnhealthy {
+		return nil
+	}
+	return version.rules
+}
+
+// States provides the state of every version that has been read.
+func (r *versionCache) States() map[string]VersionState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	states := make(map[string]VersionState, len(r.versions))
+	for name, version := range r.versions {
+		state := VersionState{
+			Percentage:  version.percentage,
+			LastUpdated: version.lastUpdated,
+			IsUnhealthy: version.isUnhealthy,
+		}
+		if version.schedule != nil {
+			state.Schedule = version.schedule.String()
+		}
+		states[name] = state
+	}
+	return states
+}
+
+// A FileRollout represents a rollout that is continuously read from a local
+// JSON file holding an object that maps version names to rollout values, e.g.
+// {"maintenance": 0, "canary": 0.05}.
+// A version may instead map to an object holding its rollout value along with
+// a ramp schedule (see ParseSchedule) and its start time in seconds since the
+// Unix epoch, e.g.
+// {"canary": {"rollout": 0, "schedule": "0.01:1h,0.25:4h,1", "start": 1476600000}}.
+// The "rules" entry holds an array of targeting rules (see ParseRules).
+// The file is re-read whenever its modification time or size changes.
+// If the file cannot be read or parsed for long enough, the rollout value will
+// drop to 0, exactly as with a DynamoDBRollout.
+type FileRollout struct {
+	*versionCache
+	filename  string
+	delay     time.Duration
+	unhealthy time.Duration
+}
+
+// A fileRolloutEntry is a version in a rollout file that has a ramp schedule.
+type fileRolloutEntry struct {
+	Rollout  *float64 `json:"rollout"`
+	Schedule string   `json:"schedule"`
+	Start    *float64 `json:"start"`
+}
+
+// parseFileRolloutEntry parses a single version of a rollout file.
+func parseFileRolloutEntry(name string, raw json.RawMessage) (rolloutValue, error) {
+	var value rolloutValue
+	if name == "" {
+		return value, fmt.Errorf("release name is empty string")
+	}
+	if name == rulesVersion {
+		rules, err := ParseRules(raw)
+		value.rules = rules
+		return value, err
+	}
+	err := json.Unmarshal(raw, &value.percentage)
+	if err == nil {
+		if value.percentage < 0 || value.percentage > 1 {
+			return value, fmt.Errorf("rollout value is out of [0.0,1.0] range")
+		}
+		return value, nil
+	}
+	var entry fileRolloutEntry
+	err = json.Unmarshal(raw, &entry)
+	if err != nil {
+		return value, fmt.Errorf("rollout value is neither a number nor an object")
+	}
+	if entry.Rollout == nil {
+		return value, fmt.Errorf("could not find \"rollout\" key in entry")
+	}
+	value.percentage = *entry.Rollout
+	if value.percentage < 0 || value.percentage > 1 {
+		return value, fmt.Errorf("rollout value is out of [0.0,1.0] range")
+	}
+	if entry.Schedule != "" {
+		if entry.Start == nil {
+			return value, fmt.Errorf("could not find \"start\" key in entry")
+		}
+		value.schedule, err = ParseSchedule(entry.Schedule, unixSeconds(*entry.Start))
+		if err != nil {
+			return value, fmt.Errorf("could not parse schedule: %v", err)
+		}
+	}
+	return value, nil
+}
+
+// parseRolloutDocument parses a JSON object mapping version names to rollout
+// values, as held by a rollout file, recording the result of every version.
+// It provides nil if the document itself cannot be parsed.
+func parseRolloutDocument(monitor Monitor, data []byte) map[string]rolloutValue {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		monitor.RecordRolloutUpdate(err)
+		log.Printf("could not parse rollout document: %v", err)
+		return nil
+	}
+	results := make(map[string]rolloutValue)
+	for name, entry := range raw {
+		value, err := parseFileRolloutEntry(name, entry)
+		monitor.RecordRolloutUpdate(err)
+		if err != nil {
+			log.Printf("rollout: error during update: %v", err)
+			continue
+		}
+		results[name] = value
+	}
+	return results
+}
+
+// NewFileRollout creates a new FileRollout and begins eternally checking the
+// given file for changes, interspersed with the given delay.
+// If the file is missing or unparseable for the specified amount of time,
+// rollout will be dropped 0.0.
+func NewFileRollout(monitor Monitor, filename string, delay time.Duration, unhealthy time.Duration) (*FileRollout, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("filename string is empty")
+	}
+	fileRollout := &FileRollout{
+		versionCache: newVersionCache(monitor),
+		filename:     filename,
+		delay:        delay,
+		unhealthy:    unhealthy,
+	}
+	var lastInfo os.FileInfo
+	var current map[string]rolloutValue
+	missing := false
+	loadRollouts := func() map[string]rolloutValue {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			monitor.RecordRolloutUpdate(err)
+			log.Printf("could not read rollout file: %v", err)
+			return nil
+		}
+		return parseRolloutDocument(monitor, data)
+	}
+	go func() {
+		for {
+			info, err := os.Stat(filename)
+			if err != nil {
+				if !missing {
+					monitor.RecordRolloutUpdate(err)
+					log.Printf("could not stat rollout file: %v", err)
+				}
+				missing = true
+				lastInfo = nil
+				current = nil
+			} else if lastInfo == nil || !info.ModTime().Equal(lastInfo.ModTime()) || info.Size() != lastInfo.Size() {
+				missing = false
+				lastInfo = info
+				current = loadRollouts()
+			}
+			fileRollout.mutex.RLock()
+			delay, unhealthy := fileRollout.delay, fileRollout.unhealthy
+			fileRollout.mutex.RUnlock()
+			fileRollout.update(unhealthy, current)
+			time.Sleep(delay)
+		}
+	}()
+	return fileRollout, nil
+}
+
+// Tune replaces the delay between checks of the file and the unhealthy
+// duration, from the next check on.
+func (fileRollout *FileRollout) Tune(delay time.Duration, unhealthy time.Duration) {
+	fileRollout.mutex.Lock()
+	defer fileRollout.mutex.Unlock()
+	fileRollout.delay = delay
+	fileRollout.unhealthy = unhealthy
+}
+
+// An HTTPRollout represents a rollout that is continuously fetched from a URL
+// serving a JSON document in the same format as a FileRollout's file.
+// The document is requested with the ETag of the last response, so that an
+// unchanged document is not parsed again.
+// If the document cannot be fetched or parsed for long enough, the rollout
+// value will drop to 0, exactly as with a DynamoDBRollout.
+type HTTPRollout struct {
+	*versionCache
+	url       string
+	client    *http.Client
+	delay     time.Duration
+	unhealthy time.Duration
+}
+
+// NewHTTPRollout creates a new HTTPRollout and begins eternally requesting the
+// given URL, interspersed with the given delay.
+// If the document cannot be fetched or parsed for the specified amount of
+// time, rollout will be dropped 0.0.
+func NewHTTPRollout(monitor Monitor, url string, delay time.Duration, unhealthy time.Duration) (*HTTPRollout, error) {
+	if url == "" {
+		return nil, fmt.Errorf("url string is empty")
+	}
+	httpRollout := &HTTPRollout{
+		versionCache: newVersionCache(monitor),
+		url:          url,
+		client: &http.Client{
+			Timeout: time.Second,
+		},
+		delay:     delay,
+		unhealthy: unhealthy,
+	}
+	var current map[string]rolloutValue
+	etag := ""
+	go func() {
+		for {
+			current, etag = httpRollout.fetch(monitor, current, etag)
+			httpRollout.mutex.RLock()
+			delay, unhealthy := httpRollout.delay, httpRollout.unhealthy
+			httpRollout.mutex.RUnlock()
+			httpRollout.update(unhealthy, current)
+			time.Sleep(delay)
+		}
+	}()
+	return httpRollout, nil
+}
+
+// fetch requests the document, providing its parsed values along with its
+// ETag, or the given values and ETag if it has not changed since.
+// It provides nil if the document cannot be fetched or parsed.
+func (httpRollout *HTTPRollout) fetch(monitor Monitor, current map[string]rolloutValue, etag string) (map[string]rolloutValue, string) {
+	request, err := http.NewRequest("GET", httpRollout.url, nil)
+	if err != nil {
+		monitor.RecordRolloutUpdate(err)
+		log.Printf("could not create rollout request: %v", err)
+		return nil, ""
+	}
+	if etag != "" && current != nil {
+		request.Header.Set("If-None-Match", etag)
+	}
+	response, err := httpRollout.client.Do(request)
+	if err != nil {
+		monitor.RecordRolloutUpdate(err)
+		log.Printf("could not fetch rollout document: %v", err)
+		return nil, ""
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified && current != nil {
+		return current, etag
+	}
+	if response.StatusCode != http.StatusOK {
+		err := fmt.Errorf("status %v", response.StatusCode)
+		monitor.RecordRolloutUpdate(err)
+		log.Printf("could not fetch rollout document: %v", err)
+		return nil, ""
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		monitor.RecordRolloutUpdate(err)
+		log.Printf("could not read rollout document: %v", err)
+		return nil, ""
+	}
+	results := parseRolloutDocument(monitor, data)
+	if results == nil {
+		return nil, ""
+	}
+	return results, response.Header.Get("ETag")
+}
+
+// Tune replaces the delay between requests of the document and the unhealthy
+// duration, from the next request on.
+func (httpRollout *HTTPRollout) Tune(delay time.Duration, unhealthy time.Duration) {
+	httpRollout.mutex.Lock()
+	defer httpRollout.mutex.Unlock()
+	httpRollout.delay = delay
+	httpRollout.unhealthy = unhealthy
+}
+
+// A ConstantRollout represents a rollout that will always have the same value
+// for a single "canary" version.
 type ConstantRollout struct {
 	value float64
 }
@@ -211,8 +816,142 @@ func NewConstantRollout(value float64) *ConstantRollout {
 	}
 }
 
-// Get provides the rollout value that this value was created with.
+// Get provides the rollout value that this value was created with for the
+// "canary" version, and nil for any other version (so that, e.g., maintenance
+// mode is left as it is).
 // The return value may be outside of the [0.0,1.0] range.
-func (constantRollout *ConstantRollout) Get(_ string) *float64 {
+func (constantRollout *ConstantRollout) Get(name string) *float64 {
+	if name != "canary" {
+		return nil
+	}
 	return &constantRollout.value
 }
+
+// Versions provides the single "canary" version.
+func (constantRollout *ConstantRollout) Versions() []string {
+	return []string{"canary"}
+}
+
+// An Override describes a rollout value pinned locally for a single version.
+type Override struct {
+	Percentage float64   `json:"percentage"`
+	Expires    time.Time `json:"expires"`
+}
+
+// An OverrideRollout represents a rollout that provides the values of another
+// rollout, except for versions whose value has been temporarily pinned on this
+// host (e.g. for debugging).
+type OverrideRollout struct {
+	rollout   Rollout
+	mutex     *sync.RWMutex
+	overrides map[string]Override
+	changes   uint64
+}
+
+// NewOverrideRollout creates a rollout that provides the values of the given
+// rollout until overridden.
+func NewOverrideRollout(rollout Rollout) *OverrideRollout {
+	return &OverrideRollout{
+		rollout:   rollout,
+		mutex:     &sync.RWMutex{},
+		overrides: make(map[string]Override),
+	}
+}
+
+// Override pins the value of the given version for the given duration.
+func (overrideRollout *OverrideRollout) Override(name string, percentage float64, duration time.Duration) {
+	overrideRollout.mutex.Lock()
+	overrideRollout.overrides[name] = Override{
+		Percentage: percentage,
+		Expires:    time.Now().Add(duration),
+	}
+	overrideRollout.changes++
+	overrideRollout.mutex.Unlock()
+	log.Printf("rollout: \"%v\" overridden to %v for %v", name, percentage, duration)
+}
+
+// ClearOverride removes any pinned value of the given version.
+func (overrideRollout *OverrideRollout) ClearOverride(name string) {
+	overrideRollout.mutex.Lock()
+	delete(overrideRollout.overrides, name)
+	overrideRollout.changes++
+	overrideRollout.mutex.Unlock()
+	log.Printf("rollout: \"%v\" override cleared", name)
+}
+
+// Overrides provides every unexpired override.
+func (overrideRollout *OverrideRollout) Overrides() map[string]Override {
+	overrideRollout.mutex.RLock()
+	defer overrideRollout.mutex.RUnlock()
+	overrides := make(map[string]Override)
+	for name, override := range overrideRollout.overrides {
+		if time.Now().Before(override.Expires) {
+			overrides[name] = override
+		}
+	}
+	return overrides
+}
+
+// Get provides the overridden value of the given version if there is one,
+// otherwise the value of the underlying rollout.
+// The return value may be outside of the [0.0,1.0] range.
+func (overrideRollout *OverrideRollout) Get(name string) *float64 {
+	overrideRollout.mutex.RLock()
+	override, ok := overrideRollout.overrides[name]
+	overrideRollout.mutex.RUnlock()
+	if ok && time.Now().Before(override.Expires) {
+		return &override.Percentage
+	}
+	return overrideRollout.rollout.Get(name)
+}
+
+// Versions provides the versions of the underlying rollout along with any
+// overridden versions.
+func (overrideRollout *OverrideRollout) Versions() []string {
+	names := overrideRollout.rollout.Versions()
+	for name := range overrideRollout.Overrides() {
+		found := false
+		for _, existing := range names {
+			if existing == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Generation provides the generation of the underlying rollout (or 0 if it
+// has none) plus the number of times an override has been set or cleared.
+func (overrideRollout *OverrideRollout) Generation() uint64 {
+	overrideRollout.mutex.RLock()
+	generation := overrideRollout.changes
+	overrideRollout.mutex.RUnlock()
+	if generational, ok := overrideRollout.rollout.(GenerationalRollout); ok {
+		generation += generational.Generation()
+	}
+	return generation
+}
+
+// Rules provides the targeting rules of the underlying rollout, if it has any.
+func (overrideRollout *OverrideRollout) Rules() []Rule {
+	targeted, ok := overrideRollout.rollout.(TargetedRollout)
+	if !ok {
+		return nil
+	}
+	return targeted.Rules()
+}
+
+// States provides the state of every version of the underlying rollout, if it
+// is inspectable.
+// Overrides are not reflected; see Overrides.
+func (overrideRollout *OverrideRollout) States() map[string]VersionState {
+	inspectable, ok := overrideRollout.rollout.(InspectableRollout)
+	if !ok {
+		return nil
+	}
+	return inspectable.States()
+}
@@ -3,8 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,11 +24,15 @@ var region = flag.String("region", "us-west-2", "AWS region for DynamoDB")
 var table = flag.String("table", "development-Deployment.Canarying", "DynamoDB table used for storage")
 
 func putRolloutValue(db *dynamodb.DynamoDB, application string, value *dynamodb.AttributeValue) error {
+	return putVersionRolloutValue(db, application, "canary", value)
+}
+
+func putVersionRolloutValue(db *dynamodb.DynamoDB, application string, version string, value *dynamodb.AttributeValue) error {
 	putItemInput := &dynamodb.PutItemInput{
 		TableName: table,
 		Item: map[string]*dynamodb.AttributeValue{
 			"application": {S: aws.String(application)},
-			"version":     {S: aws.String("canary")},
+			"version":     {S: aws.String(version)},
 			"rollout":     value,
 		},
 	}
@@ -30,11 +41,15 @@ func putRolloutValue(db *dynamodb.DynamoDB, application string, value *dynamodb.
 }
 
 func deleteRollout(db *dynamodb.DynamoDB, application string) error {
+	return deleteVersionRollout(db, application, "canary")
+}
+
+func deleteVersionRollout(db *dynamodb.DynamoDB, application string, version string) error {
 	deleteItemInput := &dynamodb.DeleteItemInput{
 		TableName: table,
 		Key: map[string]*dynamodb.AttributeValue{
 			"application": {S: aws.String(application)},
-			"version":     {S: aws.String("canary")},
+			"version":     {S: aws.String(version)},
 		},
 	}
 	_, err := db.DeleteItem(deleteItemInput)
@@ -56,7 +71,7 @@ func TestDynamoDBRolloutUpdate(t *testing.T) {
 		t.Fatalf("error writing to dynamodb: %v", err)
 	}
 	defer deleteRollout(db, key)
-	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second)
+	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second, "")
 	time.Sleep(1 * time.Second)
 	value := rollout.Get("canary")
 	if value == nil || *value != 0.5 {
@@ -74,7 +89,7 @@ func TestDynamoDBRolloutMissing(t *testing.T) {
 	config := aws.NewConfig().WithRegion(*region).WithHTTPClient(client).WithMaxRetries(2)
 	db := dynamodb.New(session.New(), config)
 	key := fmt.Sprintf("test-%v", rand.Float64())
-	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second)
+	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second, "")
 	time.Sleep(1 * time.Second)
 	value := rollout.Get("canary")
 	if value != nil {
@@ -97,7 +112,7 @@ func TestDynamoDBRolloutType(t *testing.T) {
 		t.Fatalf("error writing to dynamodb: %v", err)
 	}
 	defer deleteRollout(db, key)
-	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second)
+	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second, "")
 	time.Sleep(1 * time.Second)
 	value := rollout.Get("canary")
 	if value != nil {
@@ -120,10 +135,351 @@ func TestDynamoDBRolloutCall(t *testing.T) {
 		t.Fatalf("error writing to dynamodb: %v", err)
 	}
 	defer deleteRollout(db, key)
-	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second)
+	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second, "")
 	time.Sleep(1 * time.Second)
 	value := rollout.Get("canaryyyyy!!!")
 	if value != nil {
 		t.Fatalf("expected to read nil, read %v", value)
 	}
 }
+
+func TestDynamoDBRolloutVersions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	client := &http.Client{
+		Timeout: time.Second,
+	}
+	config := aws.NewConfig().WithRegion(*region).WithHTTPClient(client).WithMaxRetries(2)
+	db := dynamodb.New(session.New(), config)
+	key := fmt.Sprintf("test-%v", rand.Float64())
+	for version, value := range map[string]string{"canary-a": "0.1", "canary-b": "0.2"} {
+		err := putVersionRolloutValue(db, key, version, &dynamodb.AttributeValue{N: aws.String(value)})
+		if err != nil {
+			t.Fatalf("error writing to dynamodb: %v", err)
+		}
+		defer deleteVersionRollout(db, key, version)
+	}
+	rollout, _ := NewDynamoDBRollout(&NilMonitor{}, db, *table, key, time.Second, 8*time.Second, "")
+	time.Sleep(1 * time.Second)
+	if len(rollout.Versions()) != 2 {
+		t.Fatalf("expected to discover 2 versions, found %v", rollout.Versions())
+	}
+	value := rollout.Get("canary-b")
+	if value == nil || *value != 0.2 {
+		t.Fatalf("expected to read 0.2, read %v", value)
+	}
+}
+
+func writeRolloutFile(t *testing.T, filename string, contents string) {
+	err := ioutil.WriteFile(filename, []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("could not write rollout file: %v", err)
+	}
+}
+
+func TestFileRolloutUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "rollout.json")
+	writeRolloutFile(t, filename, `{"maintenance": 0, "canary": 0.5}`)
+	rollout, err := NewFileRollout(&NilMonitor{}, filename, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(8 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.5 {
+		t.Fatalf("expected to read 0.5, read %v", value)
+	}
+	writeRolloutFile(t, filename, `{"maintenance": 0, "canary": 0.25, "canary-b": 0.125}`)
+	time.Sleep(8 * time.Millisecond)
+	value = rollout.Get("canary-b")
+	if value == nil || *value != 0.125 {
+		t.Fatalf("expected to reload 0.125, read %v", value)
+	}
+}
+
+func TestFileRolloutUnparseable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "rollout.json")
+	writeRolloutFile(t, filename, `{"canary": 0.5}`)
+	rollout, err := NewFileRollout(&NilMonitor{}, filename, time.Millisecond, 64*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(8 * time.Millisecond)
+	writeRolloutFile(t, filename, `{"canary": `)
+	time.Sleep(8 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.5 {
+		t.Fatalf("expected to keep 0.5, read %v", value)
+	}
+	time.Sleep(128 * time.Millisecond)
+	value = rollout.Get("canary")
+	if value != nil {
+		t.Fatalf("expected to read nil, read %v", value)
+	}
+}
+
+func TestFileRolloutMissing(t *testing.T) {
+	rollout, err := NewFileRollout(&NilMonitor{}, "/this/directory/doesnt.exist", time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(8 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value != nil {
+		t.Fatalf("expected to read nil, read %v", value)
+	}
+}
+
+func TestHTTPRollout(t *testing.T) {
+	mutex := &sync.Mutex{}
+	document := `{"maintenance": 0, "canary": 0.5}`
+	requests, unchanged := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		etag := fmt.Sprintf("%q", document)
+		if r.Header.Get("If-None-Match") == etag {
+			unchanged++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if document == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, document)
+	}))
+	defer server.Close()
+	rollout, err := NewHTTPRollout(&NilMonitor{}, server.URL, time.Millisecond, 64*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(16 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.5 {
+		t.Fatalf("expected to read 0.5, read %v", value)
+	}
+	mutex.Lock()
+	if requests < 2 || unchanged != requests-1 {
+		t.Fatalf("expected an unchanged document to be requested conditionally, got %v of %v requests", unchanged, requests)
+	}
+	document = `{"maintenance": 0, "canary": 0.25}`
+	mutex.Unlock()
+	time.Sleep(16 * time.Millisecond)
+	value = rollout.Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected to reload 0.25, read %v", value)
+	}
+	mutex.Lock()
+	document = ""
+	mutex.Unlock()
+	time.Sleep(16 * time.Millisecond)
+	value = rollout.Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected to keep 0.25, read %v", value)
+	}
+	time.Sleep(128 * time.Millisecond)
+	value = rollout.Get("canary")
+	if value != nil {
+		t.Fatalf("expected to read nil, read %v", value)
+	}
+}
+
+func TestOverrideRolloutExpiry(t *testing.T) {
+	rollout := NewOverrideRollout(NewConstantRollout(0.25))
+	rollout.Override("canary", 1, time.Millisecond)
+	time.Sleep(4 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.25 {
+		t.Fatalf("expected expired override to fall back to 0.25, got %v", value)
+	}
+}
+
+func TestFileRolloutSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "rollout.json")
+	start := time.Now().Add(-90 * time.Minute).Unix()
+	writeRolloutFile(t, filename, fmt.Sprintf(`{"canary": {"rollout": 0, "schedule": "0.01:1h,0.05:1h,1", "start": %v}, "later": {"rollout": 0.5, "schedule": "1", "start": %v}}`, start, start+3*3600))
+	rollout, err := NewFileRollout(&NilMonitor{}, filename, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(8 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.05 {
+		t.Fatalf("expected to read the second step 0.05, read %v", value)
+	}
+	value = rollout.Get("later")
+	if value == nil || *value != 0.5 {
+		t.Fatalf("expected to read 0.5 before the schedule starts, read %v", value)
+	}
+}
+
+func TestFileRolloutRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "rollout.json")
+	writeRolloutFile(t, filename, `{"canary": 0.5, "rules": [{"version": "canary", "users": ["qa"]}]}`)
+	rollout, err := NewFileRollout(&NilMonitor{}, filename, time.Millisecond, 64*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(8 * time.Millisecond)
+	rules := rollout.Rules()
+	if len(rules) != 1 || rules[0].Version != "canary" {
+		t.Fatalf("expected to read a single rule, read %+v", rules)
+	}
+	os.Remove(filename)
+	time.Sleep(128 * time.Millisecond)
+	if rules := rollout.Rules(); rules != nil {
+		t.Fatalf("expected stale rules to be dropped, read %+v", rules)
+	}
+}
+
+func TestFileRolloutGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "rollout.json")
+	writeRolloutFile(t, filename, `{"canary": 0.5, "rules": [{"version": "canary", "users": ["qa"]}]}`)
+	rollout, err := NewFileRollout(&NilMonitor{}, filename, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("error creating rollout: %v", err)
+	}
+	time.Sleep(8 * time.Millisecond)
+	generation := rollout.Generation()
+	writeRolloutFile(t, filename, `{"canary": 0.50, "rules": [{"version": "canary", "users": ["qa"]}]} `)
+	time.Sleep(8 * time.Millisecond)
+	if rollout.Generation() != generation {
+		t.Fatalf("expected generation %v to be kept for identical values, got %v", generation, rollout.Generation())
+	}
+	writeRolloutFile(t, filename, `{"canary": 0.25, "rules": [{"version": "canary", "users": ["qa"]}]}`)
+	time.Sleep(8 * time.Millisecond)
+	if rollout.Generation() <= generation {
+		t.Fatalf("expected generation to increase from %v, got %v", generation, rollout.Generation())
+	}
+
+	// a schedule advancing to its next step changes the generation
+	start := float64(time.Now().Add(-time.Hour+32*time.Millisecond).UnixNano()) / float64(time.Second)
+	writeRolloutFile(t, filename, fmt.Sprintf(`{"canary": {"rollout": 0, "schedule": "0.01:1h,0.5:1h,1", "start": %f}}`, start))
+	time.Sleep(8 * time.Millisecond)
+	generation = rollout.Generation()
+	time.Sleep(64 * time.Millisecond)
+	value := rollout.Get("canary")
+	if value == nil || *value != 0.5 || rollout.Generation() <= generation {
+		t.Fatalf("expected generation to increase from %v along with the step, got %v at %v", generation, rollout.Generation(), value)
+	}
+	// and replacing the schedule never decreases it
+	generation = rollout.Generation()
+	writeRolloutFile(t, filename, `{"canary": 0.5}`)
+	time.Sleep(8 * time.Millisecond)
+	if rollout.Generation() <= generation {
+		t.Fatalf("expected generation to increase from %v, got %v", generation, rollout.Generation())
+	}
+}
+
+// A stateMonitor records the rollout values, unhealthy transitions and
+// maintenance transitions it is given.
+type stateMonitor struct {
+	NilMonitor
+	mutex       *sync.Mutex
+	values      map[string]float64
+	staleness   map[string]time.Duration
+	transitions []string
+}
+
+func newStateMonitor() *stateMonitor {
+	return &stateMonitor{
+		mutex:     &sync.Mutex{},
+		values:    make(map[string]float64),
+		staleness: make(map[string]time.Duration),
+	}
+}
+
+func (monitor *stateMonitor) RecordRolloutValue(version string, value float64) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.values[version] = value
+}
+
+func (monitor *stateMonitor) RecordStaleness(version string, staleness time.Duration) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.staleness[version] = staleness
+}
+
+func (monitor *stateMonitor) RecordUnhealthy(version string, unhealthy bool) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.transitions = append(monitor.transitions, fmt.Sprintf("%v unhealthy: %v", version, unhealthy))
+}
+
+func (monitor *stateMonitor) RecordMaintenance(on bool) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.transitions = append(monitor.transitions, fmt.Sprintf("maintenance: %v", on))
+}
+
+func TestVersionCacheMonitoring(t *testing.T) {
+	monitor := newStateMonitor()
+	cache := newVersionCache(monitor)
+	schedule, err := ParseSchedule("0.01:1h,1", time.Now().Add(-30*time.Minute))
+	if err != nil {
+		t.Fatalf("error parsing schedule: %v", err)
+	}
+	cache.update(time.Hour, map[string]rolloutValue{
+		"canary":     {percentage: 0.25},
+		"scheduled":  {percentage: 0, schedule: schedule},
+		rulesVersion: {},
+	})
+	if monitor.values["canary"] != 0.25 || monitor.values["scheduled"] != 0.01 || len(monitor.values) != 2 {
+		t.Fatalf("expected the values served, got %v", monitor.values)
+	}
+	if len(monitor.staleness) != 3 || monitor.staleness["canary"] > time.Second {
+		t.Fatalf("expected fresh versions, got %v", monitor.staleness)
+	}
+
+	// versions go stale once, and recover once read again
+	time.Sleep(2 * time.Millisecond)
+	cache.update(time.Millisecond, nil)
+	cache.update(time.Millisecond, nil)
+	if monitor.values["canary"] != 0 || monitor.staleness["canary"] < time.Millisecond {
+		t.Fatalf("expected a stale version at 0, got %v, %v", monitor.values, monitor.staleness)
+	}
+	cache.update(time.Hour, map[string]rolloutValue{"canary": {percentage: 0.5}})
+	sort.Strings(monitor.transitions)
+	expected := []string{
+		"canary unhealthy: false",
+		"canary unhealthy: true",
+		"rules unhealthy: true",
+		"scheduled unhealthy: true",
+	}
+	if strings.Join(monitor.transitions, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected transitions %v, got %v", expected, monitor.transitions)
+	}
+	if monitor.values["canary"] != 0.5 {
+		t.Fatalf("expected to record 0.5, got %v", monitor.values["canary"])
+	}
+}
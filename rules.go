@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// rulesVersion is the rollout entry holding targeting rules rather than a
+// rollout value.
+const rulesVersion string = "rules"
+
+// A Request holds what is known about a single decision request.
+// Only Input is required; the other attributes are set by servers that can
+// provide them and are used to match targeting rules.
+type Request struct {
+	// Input is the assignment (or "key:" identifier) as given by the client.
+	Input string
+	// Application is the name of the application the request is for, or
+	// empty for the default application.
+	Application string
+	// Key is a stable identifier of the client, such as a user ID, as
+	// given by the proxy (never taken from the client's "key:" input).
+	Key string
+	// IP is the address of the end user (not of the proxy).
+	IP net.IP
+	// Path is the path of the proxied request.
+	Path string
+	// Host is the host of the proxied request.
+	Host string
+	// Header holds the headers of the proxied request.
+	Header http.Header
+	// Attributes holds any other attributes given by the proxy.
+	Attributes map[string]string
+	// TraceParent is the W3C traceparent of the trace the request is part
+	// of, if the client gave one.
+	TraceParent string
+}
+
+// A Rule represents a targeting rule that pins matching requests to a single
+// version (which may be "master") regardless of their assignment.
+// A request matches once it satisfies every condition that is set: its key is
+// one of the given users, its IP is within one of the given networks, its host
+// is one of the given hosts, each of the given headers and attributes has
+// exactly the given value, and its path begins with the given prefix.
+type Rule struct {
+	Version    string            `json:"version"`
+	Users      []string          `json:"users,omitempty"`
+	Networks   []string          `json:"networks,omitempty"`
+	Hosts      []string          `json:"hosts,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	PathPrefix string            `json:"pathPrefix,omitempty"`
+	networks   []*net.IPNet
+}
+
+// A TargetedRollout is a Rollout that can also provide targeting rules.
+type TargetedRollout interface {
+	Rollout
+	// Rules provides the current targeting rules, in order of precedence.
+	// nil will be returned if there are none or they are stale.
+	Rules() []Rule
+}
+
+// ParseRules parses a JSON array of rules, e.g.
+// [{"version": "canary", "headers": {"X-Employee": "true"}},
+// {"version": "master", "users": ["1234"]}].
+func ParseRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rules: %v", err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Version == "" || (reservedVersions[rule.Version] && rule.Version != "master") {
+			return nil, fmt.Errorf("rule %v: invalid version \"%v\"", i+1, rule.Version)
+		}
+		if len(rule.Users) == 0 && len(rule.Networks) == 0 && len(rule.Hosts) == 0 && len(rule.Headers) == 0 && len(rule.Attributes) == 0 && rule.PathPrefix == "" {
+			return nil, fmt.Errorf("rule %v: no conditions", i+1)
+		}
+		for j, host := range rule.Hosts {
+			rule.Hosts[j] = strings.ToLower(host)
+		}
+		rule.networks, err = ParseNetworks(strings.Join(rule.Networks, ","))
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: could not parse networks: %v", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// contains provides whether the given list holds the given value.
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches provides whether the given request satisfies every condition of the
+// rule.
+func (rule *Rule) Matches(request *Request) bool {
+	if len(rule.Users) > 0 && !contains(rule.Users, request.Key) {
+		return false
+	}
+	if len(rule.Hosts) > 0 {
+		host := request.Host
+		if withoutPort, _, err := net.SplitHostPort(host); err == nil {
+			host = withoutPort
+		}
+		if !contains(rule.Hosts, strings.ToLower(host)) {
+			return false
+		}
+	}
+	if len(rule.networks) > 0 {
+		found := false
+		for _, network := range rule.networks {
+			if request.IP != nil && network.Contains(request.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range rule.Headers {
+		if request.Header.Get(name) != value {
+			return false
+		}
+	}
+	for name, value := range rule.Attributes {
+		if request.Attributes[name] != value {
+			return false
+		}
+	}
+	return strings.HasPrefix(request.Path, rule.PathPrefix)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"version": "canary"}`,
+		`[{"users": ["1"]}]`,
+		`[{"version": "maintenance", "users": ["1"]}]`,
+		`[{"version": "canary"}]`,
+		`[{"version": "canary", "networks": ["10.0.0.0/33"]}]`,
+	} {
+		_, err := ParseRules([]byte(data))
+		if err == nil {
+			t.Errorf("expected an error parsing %v", data)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	rules, err := ParseRules([]byte(`[{"version": "canary", "networks": ["10.0.0.0/8"], "headers": {"X-Employee": "true"}, "pathPrefix": "/beta"}]`))
+	if err != nil {
+		t.Fatalf("error parsing rules: %v", err)
+	}
+	header := http.Header{}
+	header.Set("X-Employee", "true")
+	cases := []struct {
+		request Request
+		matches bool
+	}{
+		{Request{IP: net.ParseIP("10.1.2.3"), Path: "/beta/page", Header: header}, true},
+		{Request{IP: net.ParseIP("192.168.1.1"), Path: "/beta/page", Header: header}, false},
+		{Request{IP: net.ParseIP("10.1.2.3"), Path: "/page", Header: header}, false},
+		{Request{IP: net.ParseIP("10.1.2.3"), Path: "/beta/page"}, false},
+		{Request{Path: "/beta/page", Header: header}, false},
+	}
+	for _, c := range cases {
+		if rules[0].Matches(&c.request) != c.matches {
+			t.Errorf("expected match %v for %+v", c.matches, c.request)
+		}
+	}
+}
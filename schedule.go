@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule represents a progressive ramp of rollout values (e.g. 1% for an
+// hour, then 5% for an hour, then 25%, ...) that begins at a shared start time.
+// Every daemon given the same schedule and start time computes the same step
+// without any coordination.
+type Schedule struct {
+	start time.Time
+	steps []scheduleStep
+}
+
+type scheduleStep struct {
+	percentage float64
+	hold       time.Duration
+}
+
+// unixSeconds converts a (possibly fractional) number of seconds since the Unix
+// epoch to a time.
+func unixSeconds(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// ParseSchedule creates a Schedule beginning at the given time from a
+// comma-separated list of steps, each of the form "<value>:<hold duration>"
+// (e.g. "0.01:1h,0.05:1h,0.25:4h,0.5:4h,1").
+// The hold duration of the final step may be omitted; the final value is kept
+// forever once reached.
+func ParseSchedule(spec string, start time.Time) (*Schedule, error) {
+	schedule := &Schedule{
+		start: start,
+	}
+	parts := strings.Split(spec, ",")
+	for i, part := range parts {
+		fields := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		percentage, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("step %v: could not parse rollout value: %v", i+1, err)
+		}
+		if percentage < 0 || percentage > 1 {
+			return nil, fmt.Errorf("step %v: rollout value is out of [0.0,1.0] range", i+1)
+		}
+		step := scheduleStep{
+			percentage: percentage,
+		}
+		if len(fields) == 2 {
+			step.hold, err = time.ParseDuration(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("step %v: could not parse hold duration: %v", i+1, err)
+			}
+		}
+		if step.hold <= 0 && i != len(parts)-1 {
+			return nil, fmt.Errorf("step %v: hold duration must be positive", i+1)
+		}
+		schedule.steps = append(schedule.steps, step)
+	}
+	return schedule, nil
+}
+
+// At provides the rollout value of the step in effect at the given time.
+// false is returned if the schedule has not started yet.
+func (schedule *Schedule) At(t time.Time) (float64, bool) {
+	step := schedule.Step(t)
+	if step == 0 {
+		return 0, false
+	}
+	return schedule.steps[step-1].percentage, true
+}
+
+// Step provides the number of the step in effect at the given time, counting
+// from 1, or 0 if the schedule has not started yet.
+func (schedule *Schedule) Step(t time.Time) int {
+	if t.Before(schedule.start) {
+		return 0
+	}
+	elapsed := t.Sub(schedule.start)
+	for i, step := range schedule.steps {
+		if elapsed < step.hold {
+			return i + 1
+		}
+		elapsed -= step.hold
+	}
+	return len(schedule.steps)
+}
+
+// spec provides the schedule in the form accepted by ParseSchedule.
+func (schedule *Schedule) spec() string {
+	var parts []string
+	for _, step := range schedule.steps {
+		part := strconv.FormatFloat(step.percentage, 'g', -1, 64)
+		if step.hold > 0 {
+			part += ":" + step.hold.String()
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// String provides the schedule in the form accepted by ParseSchedule, followed
+// by its start time.
+func (schedule *Schedule) String() string {
+	return fmt.Sprintf("%v from %v", schedule.spec(), schedule.start.UTC().Format(time.RFC3339))
+}
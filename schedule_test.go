@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleAt(t *testing.T) {
+	start := time.Unix(1476600000, 0)
+	schedule, err := ParseSchedule("0.01:1h, 0.05:1h, 0.25:4h, 0.5:4h, 1", start)
+	if err != nil {
+		t.Fatalf("error parsing schedule: %v", err)
+	}
+	if _, ok := schedule.At(start.Add(-time.Second)); ok {
+		t.Fatalf("schedule started before its start time")
+	}
+	cases := map[time.Duration]float64{
+		0:                             0.01,
+		59 * time.Minute:              0.01,
+		time.Hour:                     0.05,
+		2 * time.Hour:                 0.25,
+		6*time.Hour - time.Nanosecond: 0.25,
+		6 * time.Hour:                 0.5,
+		10 * time.Hour:                1,
+		1000 * time.Hour:              1,
+	}
+	for elapsed, expected := range cases {
+		value, ok := schedule.At(start.Add(elapsed))
+		if !ok || value != expected {
+			t.Errorf("expected %v after %v, got %v", expected, elapsed, value)
+		}
+	}
+}
+
+func TestScheduleFinalHold(t *testing.T) {
+	start := time.Unix(1476600000, 0)
+	schedule, err := ParseSchedule("0.1:1h,0.2:1h", start)
+	if err != nil {
+		t.Fatalf("error parsing schedule: %v", err)
+	}
+	value, ok := schedule.At(start.Add(48 * time.Hour))
+	if !ok || value != 0.2 {
+		t.Fatalf("expected the final value to be kept, got %v", value)
+	}
+}
+
+func TestScheduleStep(t *testing.T) {
+	start := time.Unix(1476600000, 0)
+	schedule, err := ParseSchedule("0.01:1h,0.05:1h,1", start)
+	if err != nil {
+		t.Fatalf("error parsing schedule: %v", err)
+	}
+	cases := map[time.Duration]int{
+		-time.Second:     0,
+		0:                1,
+		time.Hour:        2,
+		2 * time.Hour:    3,
+		1000 * time.Hour: 3,
+	}
+	for elapsed, expected := range cases {
+		step := schedule.Step(start.Add(elapsed))
+		if step != expected {
+			t.Errorf("expected step %v after %v, got %v", expected, elapsed, step)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "1.5", "0.1:1h,x", "0.1:-1h,0.2", "0.1,0.2", "0.1:forever"} {
+		_, err := ParseSchedule(spec, time.Now())
+		if err == nil {
+			t.Errorf("no error parsing schedule %q", spec)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,70 +26,228 @@ type Server interface {
 	Close() error
 }
 
-// A UnixServer represents a listener on a unix socket that forwards data to a
-// handler.
+// A deadlineListener is a listener whose Accept calls can time out.
+type deadlineListener interface {
+	net.Listener
+	SetDeadline(time.Time) error
+}
+
+// A streamServer represents a listener that forwards data to a handler.
 // This server expects data sent over a connection to be terminated with a '\n'
 // symbol.
-// The result from the handler will be sent back across the TCP connection,
-// with each entry (assignment and location) terminated with a '\n' symbol.
+// The result from the handler will be sent back across the connection, with
+// each entry (assignment and location) terminated with a '\n' symbol.
+// A request that begins with '{' is instead in the structured format (see
+// structuredRequest), and is answered with a single line in the structured
+// format (see structuredResponse).
+// If an idle timeout is set, a connection may carry any number of requests and
+// is only closed once it has been idle for that long; otherwise each
+// connection carries a single request.
+type streamServer struct {
+	listener    deadlineListener
+	allow       func(net.Conn) error
+	waitGroup   *sync.WaitGroup
+	schan       chan time.Time
+	idleTimeout time.Duration
+	mutex       *sync.Mutex
+	closing     bool
+	connections map[net.Conn]bool
+}
+
+// newStreamServer begins serving connections accepted by the given listener.
+// If allow is non-nil, connections for which it returns an error are closed
+// without being served.
+func newStreamServer(monitor Monitor, handler Handler, listener deadlineListener, allow func(net.Conn) error, idleTimeout time.Duration) *streamServer {
+	server := &streamServer{
+		listener:    listener,
+		allow:       allow,
+		waitGroup:   &sync.WaitGroup{},
+		schan:       make(chan time.Time, 1),
+		idleTimeout: idleTimeout,
+		mutex:       &sync.Mutex{},
+		connections: make(map[net.Conn]bool),
+	}
+	server.waitGroup.Add(1)
+	go server.serve(monitor, handler)
+	return server
+}
+
+// A RequestTrace describes when each phase of serving a single request of a
+// stream server ended, for monitors that trace requests (see RequestTracer).
+// Phases that were not reached are left zero.
+type RequestTrace struct {
+	// Network is the network the request was received on ("unix" or
+	// "tcp").
+	Network string
+	// Structured is whether the request was in the structured format.
+	Structured bool
+	// Parent is the W3C traceparent given by a structured request, if any.
+	Parent string
+	// Accepted is when the connection was accepted, or zero for every
+	// request but the first of a connection.
+	Accepted time.Time
+	// Started is when the first byte of the request arrived.
+	Started time.Time
+	// Read is when the whole request had been read.
+	Read time.Time
+	// Handled is when the handler had produced a response.
+	Handled time.Time
+	// Written is when the response had been written.
+	Written time.Time
+	// Ended is when serving the request ended, successfully or not.
+	Ended time.Time
+	// Err is why serving the request failed, if it did.
+	Err error
+}
+
+// A UnixServer represents a listener on a unix socket that forwards data to a
+// handler using the line protocol described by streamServer.
 type UnixServer struct {
-	listener  *net.UnixListener
-	waitGroup *sync.WaitGroup
-	schan     chan time.Time
+	*streamServer
 }
 
 // NewUnixServer creates a UnixServer that listens on the given file, passing
 // incoming traffic to the given handler.
-func NewUnixServer(monitor Monitor, handler Handler, filename string) (*UnixServer, error) {
-	addr, err := net.ResolveUnixAddr("unix", filename)
+// The socket file is given the specified mode, owner and group; an owner or
+// group of -1 is left unchanged.
+// If systemd or the process this one replaced passed a listener for the file,
+// it is used instead of creating the socket; sockets created by systemd keep
+// the permissions it gave them.
+// A zero idle timeout closes each connection after a single request.
+func NewUnixServer(monitor Monitor, handler Handler, filename string, mode os.FileMode, uid int, gid int, idleTimeout time.Duration) (*UnixServer, error) {
+	systemd := ownedBySystemd("unix", filename)
+	listener, err := listen("unix", filename)
 	if err != nil {
-		return nil, fmt.Errorf("error resolving unix address \"%v\": %v", filename, err)
+		return nil, fmt.Errorf("error creating unix listener \"%v\": %v", filename, err)
+	}
+	if !systemd {
+		err = os.Chown(filename, uid, gid)
+		if err == nil {
+			err = os.Chmod(filename, mode)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("error setting permissions of \"%v\": %v", filename, err)
+		}
+	}
+	return NewUnixServerFromListener(monitor, handler, listener.(*net.UnixListener), idleTimeout), nil
+}
+
+// removeStaleSocket removes the given socket file left behind by a daemon
+// that is no longer running, so that it can be listened on again.
+// An error is returned, and nothing removed, if the file is not a socket or
+// another process is still listening on it.
+func removeStaleSocket(filename string) error {
+	info, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	listener, err := net.ListenUnix("unix", addr)
 	if err != nil {
-		return nil, fmt.Errorf("error creating unix listener \"%v\": %v", filename, err)
+		return fmt.Errorf("could not stat \"%v\": %v", filename, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove \"%v\": not a socket", filename)
+	}
+	connection, err := net.DialTimeout("unix", filename, time.Second)
+	if err == nil {
+		connection.Close()
+		return fmt.Errorf("refusing to remove \"%v\": another process is listening on it", filename)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("refusing to remove \"%v\": could not check for a listening process: %v", filename, err)
+	}
+	err = os.Remove(filename)
+	if err != nil {
+		return fmt.Errorf("could not remove stale socket \"%v\": %v", filename, err)
 	}
-	os.Chmod(filename, 0666)
-	unixServer := &UnixServer{
-		listener:  listener,
-		waitGroup: &sync.WaitGroup{},
-		schan:     make(chan time.Time, 1),
+	return nil
+}
+
+// NewUnixServerFromListener creates a UnixServer that accepts connections from
+// the given listener (e.g. one inherited from a parent process), passing
+// incoming traffic to the given handler.
+// The socket file is left as it is, and only removed when the server is closed
+// if the listener was set to do so.
+// A zero idle timeout closes each connection after a single request.
+func NewUnixServerFromListener(monitor Monitor, handler Handler, listener *net.UnixListener, idleTimeout time.Duration) *UnixServer {
+	return &UnixServer{
+		streamServer: newStreamServer(monitor, handler, listener, nil, idleTimeout),
 	}
-	unixServer.waitGroup.Add(1)
-	go unixServer.serve(monitor, handler)
-	return unixServer, nil
 }
 
 // Close prevents new connections from being made to the server and shuts down
 // the server once existing connections are completed.
-func (unixServer *UnixServer) Close() error {
-	if unixServer.listener == nil {
+// Idle connections are closed; requests that have already been received are
+// still answered.
+func (server *streamServer) Close() error {
+	if server.listener == nil {
 		return fmt.Errorf("already stopped")
 	}
-	unixServer.schan <- time.Now()
-	unixServer.waitGroup.Wait()
-	unixServer.listener.Close()
-	unixServer.listener = nil
+	server.schan <- time.Now()
+	server.waitGroup.Wait()
+	server.listener.Close()
+	server.listener = nil
 	return nil
 }
 
-func (unixServer *UnixServer) serveConn(handler Handler, connection *net.UnixConn) error {
-	connection.SetDeadline(time.Now().Add(time.Second))
-	var buffer bytes.Buffer
-	data := make([]byte, 1024)
-	for {
-		requestLength, err := connection.Read(data)
-		if err != nil {
-			return fmt.Errorf("could not read from connection: %v", err)
+// awaitRequest extends the connection's deadline in preparation for its next
+// request, or reports false if the server is closing.
+// The first request of a connection is always awaited, since the client has
+// already been accepted.
+func (server *streamServer) awaitRequest(connection net.Conn, first bool) bool {
+	timeout := time.Second
+	if server.idleTimeout > 0 {
+		timeout = server.idleTimeout
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closing {
+		if !first {
+			return false
 		}
-		if data[requestLength-1] == '\n' {
-			buffer.Write(data[:requestLength-1])
-			break
-		} else {
-			buffer.Write(data)
+		timeout = time.Second
+	}
+	// only connections between requests are interrupted when closing
+	server.connections[connection] = !first
+	connection.SetDeadline(time.Now().Add(timeout))
+	return true
+}
+
+// beginRequest marks the connection as busy once its next request has begun
+// to arrive, so that closing the server no longer interrupts it.
+func (server *streamServer) beginRequest(connection net.Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.connections[connection] = false
+	if server.closing {
+		// closing may have interrupted the connection just as the request
+		// arrived
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+	}
+}
+
+// serveRequest serves a single request, noting when each phase of serving it
+// ended in the given trace.
+func (server *streamServer) serveRequest(handler Handler, connection net.Conn, reader *bufio.Reader, trace *RequestTrace) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("could not read from connection: %v", err)
+	}
+	trace.Read = time.Now()
+	var result string
+	if trace.Structured {
+		request, err := parseStructuredRequest(line[:len(line)-1])
+		if request != nil {
+			trace.Parent = request.TraceParent
 		}
+		result, err = respondStructured(handler, request, err)
+		if err != nil {
+			log.Printf("server: could not handle structured request: %v\n", err)
+		}
+	} else {
+		result = handler.Handle(line[:len(line)-1])
 	}
-	result := handler.Handle(string(buffer.Bytes()))
+	trace.Handled = time.Now()
 	count, err := connection.Write([]byte(result + "\n"))
 	if err != nil {
 		return fmt.Errorf("could not write to connection: %v", err)
@@ -92,21 +256,79 @@ func (unixServer *UnixServer) serveConn(handler Handler, connection *net.UnixCon
 	if count != expected {
 		return fmt.Errorf("could not write to connection: wrote %v out of %v bytes", count, expected)
 	}
+	trace.Written = time.Now()
 	return nil
 }
 
-func (unixServer *UnixServer) serve(monitor Monitor, handler Handler) {
-	defer unixServer.waitGroup.Done()
+// serveConn serves the requests of a connection accepted at the given time.
+// If the monitor is a RequestTracer, it is given the trace of every request.
+func (server *streamServer) serveConn(monitor Monitor, handler Handler, connection net.Conn, accepted time.Time) {
+	tracer, tracing := monitor.(RequestTracer)
+	reader := bufio.NewReader(connection)
+	for first := true; first || server.idleTimeout > 0; first = false {
+		if !server.awaitRequest(connection, first) {
+			return
+		}
+		// wait for the start of the next request, which also reveals its
+		// format
+		start, err := reader.Peek(1)
+		if err != nil && !first {
+			// the client hung up, went idle, or the server is closing
+			return
+		}
+		timeStart := time.Now()
+		trace := &RequestTrace{
+			Network: connection.LocalAddr().Network(),
+			Started: timeStart,
+		}
+		if first {
+			trace.Accepted = accepted
+		}
+		if err == nil {
+			server.beginRequest(connection)
+			trace.Structured = start[0] == '{'
+			err = server.serveRequest(handler, connection, reader, trace)
+		} else {
+			err = fmt.Errorf("could not read from connection: %v", err)
+		}
+		if err != nil {
+			log.Printf("server: %v\n", err)
+		}
+		monitor.RecordServe(err)
+		monitor.RecordServingTime(time.Since(timeStart))
+		if tracing {
+			trace.Ended = time.Now()
+			trace.Err = err
+			tracer.TraceRequest(trace)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (server *streamServer) serve(monitor Monitor, handler Handler) {
+	defer server.waitGroup.Done()
 	wg := &sync.WaitGroup{}
 	for {
 		select {
-		case <-unixServer.schan:
+		case <-server.schan:
+			server.mutex.Lock()
+			server.closing = true
+			for connection, idle := range server.connections {
+				// interrupt connections waiting for another request
+				if idle {
+					connection.SetReadDeadline(time.Now())
+				}
+			}
+			server.mutex.Unlock()
 			wg.Wait()
 			return
 		default:
 		}
-		unixServer.listener.SetDeadline(time.Now().Add(time.Second))
-		connection, err := unixServer.listener.Accept()
+		server.listener.SetDeadline(time.Now().Add(time.Second))
+		connection, err := server.listener.Accept()
+		accepted := time.Now()
 		if err, ok := err.(*net.OpError); ok && err.Timeout() {
 			// a timeout occurred
 			continue
@@ -114,20 +336,259 @@ func (unixServer *UnixServer) serve(monitor Monitor, handler Handler) {
 		if err != nil {
 			monitor.RecordServe(err)
 			log.Printf("server: error accepting connection: %v\n", err)
-			connection.Close()
 			continue
 		}
-		wg.Add(1)
-		go func() {
-			timeStart := time.Now()
-			err := unixServer.serveConn(handler, connection.(*net.UnixConn))
+		if server.allow != nil {
+			err := server.allow(connection)
 			if err != nil {
-				log.Printf("server: %v\n", err)
+				monitor.RecordServe(err)
+				log.Printf("server: rejected connection: %v\n", err)
+				connection.Close()
+				continue
 			}
-			monitor.RecordServe(err)
+		}
+		server.mutex.Lock()
+		server.connections[connection] = false
+		server.mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			server.serveConn(monitor, handler, connection, accepted)
+			server.mutex.Lock()
+			delete(server.connections, connection)
+			server.mutex.Unlock()
 			connection.Close()
-			monitor.RecordServingTime(time.Since(timeStart))
 			wg.Done()
 		}()
 	}
 }
+
+// A TCPServer represents a listener on a TCP address that forwards data to a
+// handler using the line protocol described by streamServer.
+// Connections may optionally be restricted to a list of client networks.
+type TCPServer struct {
+	*streamServer
+}
+
+// NewTCPServer creates a TCPServer that listens on the given address (e.g.
+// "127.0.0.1:7373"), passing incoming traffic to the given handler.
+// If any networks are given, connections from clients outside of them are
+// rejected.
+// A zero idle timeout closes each connection after a single request.
+func NewTCPServer(monitor Monitor, handler Handler, address string, allowed []*net.IPNet, idleTimeout time.Duration) (*TCPServer, error) {
+	listener, err := listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tcp listener \"%v\": %v", address, err)
+	}
+	var allow func(net.Conn) error
+	if len(allowed) > 0 {
+		allow = func(connection net.Conn) error {
+			ip := connection.RemoteAddr().(*net.TCPAddr).IP
+			for _, network := range allowed {
+				if network.Contains(ip) {
+					return nil
+				}
+			}
+			return fmt.Errorf("client %v is not in an allowed network", ip)
+		}
+	}
+	return &TCPServer{
+		streamServer: newStreamServer(monitor, handler, listener.(*net.TCPListener), allow, idleTimeout),
+	}, nil
+}
+
+// Addr provides the address the server is listening on.
+func (tcpServer *TCPServer) Addr() net.Addr {
+	return tcpServer.listener.Addr()
+}
+
+// ParseNetworks parses a comma-separated list of CIDR networks (e.g.
+// "10.0.0.0/8,192.168.1.1/32").
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// A ServerGroup represents several servers that are closed together.
+type ServerGroup []Server
+
+// Close closes every server in the group, returning the first error
+// encountered.
+func (serverGroup ServerGroup) Close() error {
+	var first error
+	for _, server := range serverGroup {
+		err := server.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// An HTTPServer represents an HTTP listener that forwards the assignment of
+// each request to a handler and returns the result in the response headers
+// "X-Maxwell-Assignment" and "X-Maxwell-Location" (along with
+// "X-Maxwell-Generation" and "X-Maxwell-Reason", if the handler provides them)
+// with a 200 status.
+// This suits proxies that cannot speak the line protocol, such as nginx's
+// auth_request module or Envoy's ext_authz filter in HTTP mode.
+// The assignment is read from a request header, falling back to a cookie; if
+// neither is set, a stable key header may be used to derive the assignment.
+// If the handler is a RequestHandler, it is also given the key, the end user's
+// IP, the original path and every header of the request.
+type HTTPServer struct {
+	monitor          Monitor
+	handler          Handler
+	assignmentHeader string
+	assignmentCookie string
+	keyHeader        string
+	ipHeader         string
+	pathHeader       string
+	appHeader        string
+	server           *http.Server
+	listener         net.Listener
+	mutex            *sync.Mutex
+}
+
+// NewHTTPServer creates an HTTPServer that listens on the given address,
+// reading assignments from the given header and cookie and keys from the
+// given key header (any of which may be empty to disable it).
+// The end user's IP and the original path are read from the given IP and path
+// headers, as set by the proxy; if they are empty or missing, the address of
+// the connection and the path of the request are used instead.
+// The application is read from the given application header; if it is empty
+// or missing, the default application is used.
+func NewHTTPServer(monitor Monitor, handler Handler, address string, assignmentHeader string, assignmentCookie string, keyHeader string, ipHeader string, pathHeader string, appHeader string) (*HTTPServer, error) {
+	listener, err := listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error creating http listener \"%v\": %v", address, err)
+	}
+	httpServer := &HTTPServer{
+		monitor:          monitor,
+		handler:          handler,
+		assignmentHeader: assignmentHeader,
+		assignmentCookie: assignmentCookie,
+		keyHeader:        keyHeader,
+		ipHeader:         ipHeader,
+		pathHeader:       pathHeader,
+		appHeader:        appHeader,
+		listener:         listener,
+		mutex:            &sync.Mutex{},
+	}
+	server := &http.Server{
+		Handler:      httpServer,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	}
+	httpServer.server = server
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("server: http listener stopped: %v\n", err)
+		}
+	}()
+	return httpServer, nil
+}
+
+// Addr provides the address the server is listening on.
+func (httpServer *HTTPServer) Addr() net.Addr {
+	return httpServer.listener.Addr()
+}
+
+// Close stops accepting requests and waits for in-flight requests to finish.
+func (httpServer *HTTPServer) Close() error {
+	httpServer.mutex.Lock()
+	defer httpServer.mutex.Unlock()
+	if httpServer.server == nil {
+		return fmt.Errorf("already stopped")
+	}
+	err := httpServer.server.Shutdown(context.Background())
+	httpServer.server = nil
+	return err
+}
+
+// input provides the handler input for the given request.
+func (httpServer *HTTPServer) input(r *http.Request) string {
+	if httpServer.assignmentHeader != "" {
+		if assignment := r.Header.Get(httpServer.assignmentHeader); assignment != "" {
+			return assignment
+		}
+	}
+	if httpServer.assignmentCookie != "" {
+		if cookie, err := r.Cookie(httpServer.assignmentCookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if httpServer.keyHeader != "" {
+		if key := r.Header.Get(httpServer.keyHeader); key != "" {
+			return keyPrefix + key
+		}
+	}
+	return ""
+}
+
+// request provides the attributes of the given request.
+func (httpServer *HTTPServer) request(r *http.Request) *Request {
+	request := &Request{
+		Input:  httpServer.input(r),
+		Path:   r.URL.Path,
+		Host:   r.Host,
+		Header: r.Header,
+	}
+	if httpServer.keyHeader != "" {
+		request.Key = r.Header.Get(httpServer.keyHeader)
+	}
+	if httpServer.appHeader != "" {
+		request.Application = r.Header.Get(httpServer.appHeader)
+	}
+	if httpServer.ipHeader != "" {
+		// X-Forwarded-For style headers list whatever the client claimed
+		// first; only the last address, added by the nearest proxy, can be
+		// trusted
+		values := r.Header[http.CanonicalHeaderKey(httpServer.ipHeader)]
+		addresses := strings.Split(strings.Join(values, ","), ",")
+		request.IP = net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1]))
+	}
+	if request.IP == nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			request.IP = net.ParseIP(host)
+		}
+	}
+	if httpServer.pathHeader != "" {
+		if original := r.Header.Get(httpServer.pathHeader); original != "" {
+			request.Path = strings.SplitN(original, "?", 2)[0]
+		}
+	}
+	return request
+}
+
+// ServeHTTP handles a single decision request.
+func (httpServer *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	decision, err := decide(httpServer.handler, httpServer.request(r))
+	if err != nil {
+		log.Printf("server: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Header().Set("X-Maxwell-Assignment", decision.Assignment)
+		w.Header().Set("X-Maxwell-Location", decision.Location)
+		if decision.Reason != "" {
+			w.Header().Set("X-Maxwell-Generation", strconv.FormatUint(decision.Generation, 10))
+			w.Header().Set("X-Maxwell-Reason", decision.Reason)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	httpServer.monitor.RecordServe(err)
+	httpServer.monitor.RecordServingTime(time.Since(timeStart))
+}
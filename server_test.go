@@ -2,15 +2,21 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
 )
 
 func TestUnixServerDoubleClose(t *testing.T) {
-	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock")
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock", 0666, -1, -1, 0)
 	if err != nil {
 		t.Fatalf("error starting server: %v", err)
 	}
@@ -24,8 +30,73 @@ func TestUnixServerDoubleClose(t *testing.T) {
 	}
 }
 
+func TestUnixServerFromListener(t *testing.T) {
+	os.Remove("/tmp/maxwells-daemon.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: "/tmp/maxwells-daemon.sock", Net: "unix"})
+	if err != nil {
+		t.Fatalf("error creating listener: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	defer os.Remove("/tmp/maxwells-daemon.sock")
+	server := NewUnixServerFromListener(&NilMonitor{}, &EchoHandler{}, listener, 0)
+	connection, err := net.Dial("unix", "/tmp/maxwells-daemon.sock")
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	connection.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(connection, "0.5\n")
+	response, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil || response != "0.5\n" {
+		t.Fatalf("Expected \"0.5\\n\", got %q (%v)", response, err)
+	}
+	server.Close()
+	if _, err := os.Stat("/tmp/maxwells-daemon.sock"); err != nil {
+		t.Fatalf("Expected the socket to be left in place: %v", err)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	err = removeStaleSocket(path.Join(dir, "missing.sock"))
+	if err != nil {
+		t.Fatalf("Unexpected error for a missing file: %v", err)
+	}
+	regular := path.Join(dir, "regular")
+	ioutil.WriteFile(regular, []byte("keep me"), 0644)
+	err = removeStaleSocket(regular)
+	if err == nil {
+		t.Fatalf("Expected an error for a regular file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Fatalf("Expected the regular file to be kept: %v", err)
+	}
+
+	filename := path.Join(dir, "maxwells-daemon.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filename, Net: "unix"})
+	if err != nil {
+		t.Fatalf("error creating listener: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	err = removeStaleSocket(filename)
+	if err == nil {
+		t.Fatalf("Expected an error for a live socket")
+	}
+	listener.Close()
+	err = removeStaleSocket(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error for a stale socket: %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stale socket to be removed, got %v", err)
+	}
+}
+
 func TestUnixServerInvalidFilename(t *testing.T) {
-	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/this/directory/doesnt.exist")
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/this/directory/doesnt.exist", 0666, -1, -1, 0)
 	if err == nil {
 		server.Close()
 		t.Fatalf("no error on invalid filename")
@@ -33,7 +104,7 @@ func TestUnixServerInvalidFilename(t *testing.T) {
 }
 
 func TestUnixServing(t *testing.T) {
-	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock")
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock", 0666, -1, -1, 0)
 	if err != nil {
 		t.Fatalf("error starting server: %v", err)
 	}
@@ -766,7 +837,7 @@ The world shall steady itself
 `
 
 func TestUnixServingLargeInput(t *testing.T) {
-	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock")
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock", 0666, -1, -1, 0)
 	if err != nil {
 		t.Fatalf("error starting server: %v", err)
 	}
@@ -792,3 +863,319 @@ func TestUnixServingLargeInput(t *testing.T) {
 		t.Fatalf("sample '%v' does not match response '%v'", input, response)
 	}
 }
+
+func TestUnixServingKeepAlive(t *testing.T) {
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock", 0666, -1, -1, time.Minute)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	connection, err := net.Dial("unix", "/tmp/maxwells-daemon.sock")
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(connection)
+	for i := 0; i < 8; i++ {
+		sample := fmt.Sprintf("0.%v\n", i)
+		fmt.Fprint(connection, sample)
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read result %v from server: %v", i, err)
+		}
+		if sample != response {
+			t.Fatalf("sample '%v' does not match response '%v'", sample, response)
+		}
+	}
+	// an idle connection must not hold up closing the server
+	timeStart := time.Now()
+	err = server.Close()
+	if err != nil {
+		t.Fatalf("error closing server: %v", err)
+	}
+	if time.Since(timeStart) > 4*time.Second {
+		t.Fatalf("closing the server waited for the idle timeout")
+	}
+	_, err = reader.ReadString('\n')
+	if err == nil {
+		t.Fatalf("connection was not closed with the server")
+	}
+}
+
+func TestUnixServingKeepAliveClosing(t *testing.T) {
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, "/tmp/maxwells-daemon.sock", 0666, -1, -1, time.Minute)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	connection, err := net.Dial("unix", "/tmp/maxwells-daemon.sock")
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(4 * time.Second))
+	reader := bufio.NewReader(connection)
+	fmt.Fprintf(connection, "0.1\n")
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read result from server: %v", err)
+	}
+	// a request that has begun to arrive must be served even if the server
+	// closes before the rest of it arrives
+	fmt.Fprintf(connection, "0.")
+	time.Sleep(16 * time.Millisecond)
+	closed := make(chan error)
+	go func() {
+		closed <- server.Close()
+	}()
+	// the server notices it is closing within a second
+	time.Sleep(1500 * time.Millisecond)
+	fmt.Fprintf(connection, "2\n")
+	response, err := reader.ReadString('\n')
+	if err != nil || response != "0.2\n" {
+		t.Fatalf("expected the request to be served while closing, got %q (%v)", response, err)
+	}
+	err = <-closed
+	if err != nil {
+		t.Fatalf("error closing server: %v", err)
+	}
+}
+
+func TestUnixServingStructured(t *testing.T) {
+	handler := NewCanaryHandler(&NilMonitor{}, NewConstantRollout(1))
+	server, err := NewUnixServer(&NilMonitor{}, handler, "/tmp/maxwells-daemon.sock", 0666, -1, -1, time.Minute)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	defer server.Close()
+	connection, err := net.Dial("unix", "/tmp/maxwells-daemon.sock")
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(connection)
+	// the original protocol keeps working on the same connection
+	fmt.Fprintf(connection, "0.5\n")
+	for _, expected := range []string{"0.5\n", "canary\n", "\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != expected {
+			t.Fatalf("expected line %q, got %q, %v", expected, line, err)
+		}
+	}
+	fmt.Fprintf(connection, "{\"v\": 2, \"assignment\": \"0.5\", \"path\": \"/\"}\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read structured response: %v", err)
+	}
+	var response structuredResponse
+	err = json.Unmarshal([]byte(line), &response)
+	if err != nil {
+		t.Fatalf("could not decode structured response %q: %v", line, err)
+	}
+	if response.V != 2 || response.Decision == nil || response.Location != "canary" || response.Assignment != "0.5" || response.Reason != "rollout" {
+		t.Fatalf("unexpected structured response %q", line)
+	}
+	fmt.Fprintf(connection, "{\"v\": 3}\n")
+	line, err = reader.ReadString('\n')
+	if err != nil || !strings.Contains(line, "\"error\"") || strings.Contains(line, "location") {
+		t.Fatalf("expected an error response, got %q, %v", line, err)
+	}
+}
+
+func TestTCPServing(t *testing.T) {
+	server, err := NewTCPServer(&NilMonitor{}, &EchoHandler{}, "127.0.0.1:0", nil, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	defer server.Close()
+	connection, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	connection.SetDeadline(time.Now().Add(time.Second))
+	sample := "0.123456789\n"
+	fmt.Fprint(connection, sample)
+	response, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read result from server: %v", err)
+	}
+	if sample != response {
+		t.Fatalf("sample '%v' does not match response '%v'", sample, response)
+	}
+}
+
+func TestTCPServerAllowlist(t *testing.T) {
+	allowed, err := ParseNetworks("10.0.0.0/8, 192.168.0.0/16")
+	if err != nil {
+		t.Fatalf("error parsing networks: %v", err)
+	}
+	server, err := NewTCPServer(&NilMonitor{}, &EchoHandler{}, "127.0.0.1:0", allowed, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	defer server.Close()
+	connection, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to server: %v", err)
+	}
+	connection.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(connection, "0.5\n")
+	_, err = bufio.NewReader(connection).ReadString('\n')
+	if err == nil {
+		t.Fatalf("connection from a disallowed client was served")
+	}
+}
+
+func TestParseNetworksInvalid(t *testing.T) {
+	_, err := ParseNetworks("10.0.0.0/8,not-a-network")
+	if err == nil {
+		t.Fatalf("no error on invalid network")
+	}
+}
+
+func TestServerGroup(t *testing.T) {
+	handler := &EchoHandler{}
+	unixServer, err := NewUnixServer(&NilMonitor{}, handler, "/tmp/maxwells-daemon.sock", 0666, -1, -1, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	tcpServer, err := NewTCPServer(&NilMonitor{}, handler, "127.0.0.1:0", nil, 0)
+	if err != nil {
+		unixServer.Close()
+		t.Fatalf("error starting server: %v", err)
+	}
+	addr := tcpServer.Addr().String()
+	group := ServerGroup{unixServer, tcpServer}
+	for _, network := range [][2]string{{"unix", "/tmp/maxwells-daemon.sock"}, {"tcp", addr}} {
+		connection, err := net.Dial(network[0], network[1])
+		if err != nil {
+			t.Fatalf("error connecting to %v server: %v", network[0], err)
+		}
+		connection.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(connection, "0.5\n")
+		response, err := bufio.NewReader(connection).ReadString('\n')
+		if err != nil || response != "0.5\n" {
+			t.Fatalf("unexpected response from %v server: %q, %v", network[0], response, err)
+		}
+		connection.Close()
+	}
+	err = group.Close()
+	if err != nil {
+		t.Fatalf("error closing servers: %v", err)
+	}
+	err = group.Close()
+	if err == nil {
+		t.Fatalf("servers were able to be doubly-closed")
+	}
+}
+
+func TestHTTPServing(t *testing.T) {
+	handler := NewCanaryHandler(&NilMonitor{}, NewConstantRollout(0.5))
+	server, err := NewHTTPServer(&NilMonitor{}, handler, "127.0.0.1:0", "maxwellsdaemon", "maxwell", "X-User", "", "", "")
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	defer server.Close()
+	cases := []struct {
+		header   string
+		cookie   string
+		location string
+	}{
+		{"0.25", "", "canary"},
+		{"", "0.75", "master"},
+		{"0.75", "0.25", "master"},
+	}
+	for _, c := range cases {
+		request, _ := http.NewRequest("GET", "http://"+server.Addr().String()+"/canary", nil)
+		if c.header != "" {
+			request.Header.Set("maxwellsdaemon", c.header)
+		}
+		if c.cookie != "" {
+			request.AddCookie(&http.Cookie{Name: "maxwell", Value: c.cookie})
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("error requesting decision: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %v", response.StatusCode)
+		}
+		if location := response.Header.Get("X-Maxwell-Location"); location != c.location {
+			t.Errorf("expected location %v for %+v, got %v", c.location, c, location)
+		}
+		if response.Header.Get("X-Maxwell-Assignment") == "" {
+			t.Errorf("no assignment returned for %+v", c)
+		}
+	}
+}
+
+func TestHTTPServingKey(t *testing.T) {
+	handler := NewCanaryHandler(&NilMonitor{}, NewConstantRollout(0.5))
+	server, err := NewHTTPServer(&NilMonitor{}, handler, "127.0.0.1:0", "maxwellsdaemon", "", "X-User", "", "", "")
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	defer server.Close()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-User", "42")
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	expected := strings.Fields(handler.Handle("key:42"))[0]
+	if assignment := recorder.Header().Get("X-Maxwell-Assignment"); assignment != expected {
+		t.Fatalf("expected assignment %v derived from key, got %v", expected, assignment)
+	}
+}
+
+func TestHTTPServingAttributes(t *testing.T) {
+	rules, err := ParseRules([]byte(`[{"version": "canary", "networks": ["203.0.113.0/24"], "pathPrefix": "/beta"}]`))
+	if err != nil {
+		t.Fatalf("error parsing rules: %v", err)
+	}
+	handler := NewCanaryHandler(&NilMonitor{}, targetedMapRollout{mapRollout{"canary": 0}, rules})
+	server, err := NewHTTPServer(&NilMonitor{}, handler, "127.0.0.1:0", "maxwellsdaemon", "", "", "X-Real-IP", "X-Original-URI", "")
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	defer server.Close()
+	cases := []struct {
+		ip       string
+		path     string
+		location string
+	}{
+		{"203.0.113.7", "/beta/page?x=1", "canary"},
+		{"198.51.100.7", "/beta/page", "master"},
+		{"203.0.113.7", "/page", "master"},
+		{"", "/beta/page", "master"},
+		// only the address appended by the nearest proxy is trusted
+		{"203.0.113.7, 198.51.100.7", "/beta/page", "master"},
+		{"198.51.100.7, 203.0.113.7", "/beta/page", "canary"},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest("GET", "/auth", nil)
+		if c.ip != "" {
+			request.Header.Set("X-Real-IP", c.ip)
+		}
+		request.Header.Set("X-Original-URI", c.path)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		if location := recorder.Header().Get("X-Maxwell-Location"); location != c.location {
+			t.Errorf("expected location %v for %+v, got %v", c.location, c, location)
+		}
+	}
+}
+
+func TestHTTPServerDoubleClose(t *testing.T) {
+	server, err := NewHTTPServer(&NilMonitor{}, &EchoHandler{}, "127.0.0.1:0", "maxwellsdaemon", "", "", "", "", "")
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	err = server.Close()
+	if err != nil {
+		t.Fatalf("error closing server: %v", err)
+	}
+	err = server.Close()
+	if err == nil {
+		t.Fatalf("server was able to be doubly-closed")
+	}
+}
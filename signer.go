@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// minimumSecretLength is the smallest accepted secret, in bytes.
+const minimumSecretLength int = 16
+
+// signatureLength is the number of bytes of the HMAC kept in a signature.
+const signatureLength int = 16
+
+// An AssignmentSigner represents a set of HMAC-SHA256 keys used to sign
+// assignments, so that clients cannot choose their own assignment.
+// Signed assignments have the form "<assignment>:<key id>:<signature>".
+// Only the first key is used for signing, but assignments signed by any of the
+// keys are accepted, which allows keys to be rotated without reassigning every
+// client.
+type AssignmentSigner struct {
+	signingID string
+	secrets   map[string][]byte
+}
+
+// LoadAssignmentSigner creates an AssignmentSigner from the keys in the given
+// file.
+// Each line holds a key ID and a base64-encoded secret separated by whitespace;
+// empty lines and lines starting with '#' are ignored.
+func LoadAssignmentSigner(filename string) (*AssignmentSigner, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening key file \"%v\": %v", filename, err)
+	}
+	defer handle.Close()
+	signer := &AssignmentSigner{
+		secrets: make(map[string][]byte),
+	}
+	scanner := bufio.NewScanner(handle)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: expected a key ID and a secret", line)
+		}
+		id := fields[0]
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("line %v: key ID contains ':'", line)
+		}
+		if _, ok := signer.secrets[id]; ok {
+			return nil, fmt.Errorf("line %v: duplicate key ID \"%v\"", line, id)
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: could not decode secret: %v", line, err)
+		}
+		if len(secret) < minimumSecretLength {
+			return nil, fmt.Errorf("line %v: secret is shorter than %v bytes", line, minimumSecretLength)
+		}
+		if signer.signingID == "" {
+			signer.signingID = id
+		}
+		signer.secrets[id] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading key file \"%v\": %v", filename, err)
+	}
+	if signer.signingID == "" {
+		return nil, fmt.Errorf("key file \"%v\" contains no keys", filename)
+	}
+	return signer, nil
+}
+
+func (signer *AssignmentSigner) signature(id string, assignment string) string {
+	mac := hmac.New(sha256.New, signer.secrets[id])
+	mac.Write([]byte(id + ":" + assignment))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:signatureLength])
+}
+
+// Sign provides the signed form of the given assignment.
+func (signer *AssignmentSigner) Sign(assignment string) string {
+	return assignment + ":" + signer.signingID + ":" + signer.signature(signer.signingID, assignment)
+}
+
+// Verify checks the signature of the given signed assignment and provides the
+// bare assignment.
+func (signer *AssignmentSigner) Verify(signed string) (string, error) {
+	parts := strings.Split(signed, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("assignment is not signed")
+	}
+	assignment, id, signature := parts[0], parts[1], parts[2]
+	if _, ok := signer.secrets[id]; !ok {
+		return "", fmt.Errorf("assignment signed with unknown key \"%v\"", id)
+	}
+	if !hmac.Equal([]byte(signature), []byte(signer.signature(id, assignment))) {
+		return "", fmt.Errorf("assignment signature is invalid")
+	}
+	return assignment, nil
+}
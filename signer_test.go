@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	filename := path.Join(dir, "keys")
+	err = ioutil.WriteFile(filename, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("could not write key file: %v", err)
+	}
+	return filename
+}
+
+func TestAssignmentSignerRoundTrip(t *testing.T) {
+	filename := writeKeyFile(t, "# current key\nfirst MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.RemoveAll(path.Dir(filename))
+	signer, err := LoadAssignmentSigner(filename)
+	if err != nil {
+		t.Fatalf("error loading keys: %v", err)
+	}
+	signed := signer.Sign("0.5")
+	if !strings.HasPrefix(signed, "0.5:first:") {
+		t.Fatalf("unexpected signed assignment %q", signed)
+	}
+	assignment, err := signer.Verify(signed)
+	if err != nil || assignment != "0.5" {
+		t.Fatalf("could not verify %q: %v", signed, err)
+	}
+	for _, tampered := range []string{"0.5", "0.1" + signed[3:], signed + "x", "0.5:second" + signed[9:]} {
+		_, err := signer.Verify(tampered)
+		if err == nil {
+			t.Errorf("tampered assignment %q was verified", tampered)
+		}
+	}
+}
+
+func TestAssignmentSignerRotation(t *testing.T) {
+	oldFilename := writeKeyFile(t, "first MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.RemoveAll(path.Dir(oldFilename))
+	newFilename := writeKeyFile(t, "second ZmVkY2JhOTg3NjU0MzIxMA==\nfirst MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.RemoveAll(path.Dir(newFilename))
+	oldSigner, err := LoadAssignmentSigner(oldFilename)
+	if err != nil {
+		t.Fatalf("error loading keys: %v", err)
+	}
+	newSigner, err := LoadAssignmentSigner(newFilename)
+	if err != nil {
+		t.Fatalf("error loading keys: %v", err)
+	}
+	_, err = newSigner.Verify(oldSigner.Sign("0.5"))
+	if err != nil {
+		t.Fatalf("could not verify assignment signed by a rotated key: %v", err)
+	}
+	if !strings.HasPrefix(newSigner.Sign("0.5"), "0.5:second:") {
+		t.Fatalf("new assignments were not signed with the first key")
+	}
+}
+
+func TestAssignmentSignerInvalidFile(t *testing.T) {
+	for _, contents := range []string{"", "first\n", "first c2hvcnQ=\n", "first !!!\n", "a:b MDEyMzQ1Njc4OWFiY2RlZg==\n"} {
+		filename := writeKeyFile(t, contents)
+		_, err := LoadAssignmentSigner(filename)
+		os.RemoveAll(path.Dir(filename))
+		if err == nil {
+			t.Errorf("no error loading key file %q", contents)
+		}
+	}
+}
+
+func TestCanaryHandlerSigned(t *testing.T) {
+	filename := writeKeyFile(t, "first MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.RemoveAll(path.Dir(filename))
+	signer, err := LoadAssignmentSigner(filename)
+	if err != nil {
+		t.Fatalf("error loading keys: %v", err)
+	}
+	handler := NewCanaryHandler(&NilMonitor{}, NewConstantRollout(1)).WithSigner(signer)
+	result := handler.Handle("")
+	if !strings.HasSuffix(result, "\ncanary\n") {
+		t.Fatalf("unexpected result %q", result)
+	}
+	assignment := strings.Fields(result)[0]
+	if _, err := signer.Verify(assignment); err != nil {
+		t.Fatalf("returned assignment is not signed: %v", err)
+	}
+	if handler.Handle(assignment) != result {
+		t.Fatalf("signed assignment %q did not round-trip", assignment)
+	}
+	result = handler.Handle("0.0000001")
+	if !strings.HasSuffix(result, "\nmaster\n") {
+		t.Fatalf("unsigned assignment was accepted: %q", result)
+	}
+}
+
+func TestCanaryHandlerSignedKey(t *testing.T) {
+	filename := writeKeyFile(t, "first MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.RemoveAll(path.Dir(filename))
+	signer, err := LoadAssignmentSigner(filename)
+	if err != nil {
+		t.Fatalf("error loading keys: %v", err)
+	}
+	handler := NewCanaryHandler(&NilMonitor{}, NewConstantRollout(1)).WithSigner(signer)
+	// a key chosen by the client is no better than an unsigned assignment
+	decision := handler.Decide(&Request{Input: "key:user"})
+	if decision.Location != "master" || decision.Reason != "unverified assignment" {
+		t.Fatalf("key given by the client was accepted: %+v", decision)
+	}
+	if result := handler.Handle("key:user"); !strings.HasSuffix(result, "\nmaster\n") {
+		t.Fatalf("key given by the client was accepted: %q", result)
+	}
+	decision = handler.Decide(&Request{Input: "key:user", Key: "user"})
+	if decision.Location != "canary" {
+		t.Fatalf("key given by the proxy was rejected: %+v", decision)
+	}
+	if _, err := signer.Verify(decision.Assignment); err != nil {
+		t.Fatalf("returned assignment is not signed: %v", err)
+	}
+}
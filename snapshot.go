@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A rolloutSnapshot holds the last rollout values successfully read from a
+// backend, in the format of a rollout file, along with when they were read.
+type rolloutSnapshot struct {
+	Fetched  time.Time                  `json:"fetched"`
+	Versions map[string]json.RawMessage `json:"versions"`
+}
+
+// encodeRolloutValue encodes a single version as a rollout file entry.
+func encodeRolloutValue(name string, value rolloutValue) (json.RawMessage, error) {
+	if name == rulesVersion {
+		return json.Marshal(value.rules)
+	}
+	if value.schedule == nil {
+		return json.Marshal(value.percentage)
+	}
+	start := float64(value.schedule.start.UnixNano()) / float64(time.Second)
+	return json.Marshal(fileRolloutEntry{
+		Rollout:  &value.percentage,
+		Schedule: value.schedule.spec(),
+		Start:    &start,
+	})
+}
+
+// persist replaces the snapshot file with the given values, read just now.
+// The file is written to a temporary file first so that it is never left
+// partially written.
+func (r *versionCache) persist(values map[string]rolloutValue) error {
+	snapshot := rolloutSnapshot{
+		Fetched:  time.Now(),
+		Versions: make(map[string]json.RawMessage, len(values)),
+	}
+	for name, value := range values {
+		raw, err := encodeRolloutValue(name, value)
+		if err != nil {
+			return fmt.Errorf("could not encode \"%v\": %v", name, err)
+		}
+		snapshot.Versions[name] = raw
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(r.snapshot), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create snapshot directory: %v", err)
+	}
+	temporary := r.snapshot + ".tmp"
+	err = ioutil.WriteFile(temporary, data, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	err = os.Rename(temporary, r.snapshot)
+	if err != nil {
+		return fmt.Errorf("could not replace snapshot: %v", err)
+	}
+	r.persisted = snapshot.Fetched
+	return nil
+}
+
+// restore loads the snapshot file, as if its values had been read when they
+// were originally fetched, so that they go stale once the unhealthy duration
+// has passed since then.
+// Nothing is loaded if the snapshot is already stale.
+func (r *versionCache) restore(unhealthy time.Duration) error {
+	data, err := ioutil.ReadFile(r.snapshot)
+	if err != nil {
+		return fmt.Errorf("could not read snapshot: %v", err)
+	}
+	var snapshot rolloutSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return fmt.Errorf("could not parse snapshot: %v", err)
+	}
+	age := time.Since(snapshot.Fetched)
+	if age > unhealthy {
+		return fmt.Errorf("snapshot fetched %v ago is stale", age)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	restored := 0
+	for name, raw := range snapshot.Versions {
+		value, err := parseFileRolloutEntry(name, raw)
+		if err != nil {
+			log.Printf("rollout: could not restore \"%v\" from snapshot: %v", name, err)
+			continue
+		}
+		r.versions[name] = &version{
+			lastUpdated: snapshot.Fetched,
+			percentage:  value.percentage,
+			schedule:    value.schedule,
+			rules:       value.rules,
+		}
+		restored++
+	}
+	if restored > 0 {
+		r.generation++
+	}
+	log.Printf("rollout: restored %v versions from snapshot fetched %v ago", restored, age)
+	return nil
+}
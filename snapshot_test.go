@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestVersionCacheSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	schedule, err := ParseSchedule("0.01:1h,1", time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("error parsing schedule: %v", err)
+	}
+	rules, err := ParseRules([]byte(`[{"version": "canary", "users": ["qa"]}]`))
+	if err != nil {
+		t.Fatalf("error parsing rules: %v", err)
+	}
+	cache := newVersionCache(&NilMonitor{})
+	cache.snapshot = path.Join(dir, "rollout", "app.json")
+	cache.update(time.Second, map[string]rolloutValue{
+		"maintenance": {percentage: 1},
+		"canary":      {percentage: 0.25, schedule: schedule},
+		rulesVersion:  {rules: rules},
+	})
+	restored := newVersionCache(&NilMonitor{})
+	restored.snapshot = cache.snapshot
+	err = restored.restore(time.Second)
+	if err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+	value := restored.Get("maintenance")
+	if value == nil || *value != 1 {
+		t.Fatalf("expected to restore 1, read %v", value)
+	}
+	value = restored.Get("canary")
+	if value == nil || *value != 1 {
+		t.Fatalf("expected to restore the schedule's final value 1, read %v", value)
+	}
+	if len(restored.Rules()) != 1 {
+		t.Fatalf("expected to restore a single rule, read %+v", restored.Rules())
+	}
+	// restored values go stale relative to when they were fetched
+	time.Sleep(64 * time.Millisecond)
+	restored.update(32*time.Millisecond, nil)
+	value = restored.Get("maintenance")
+	if value != nil {
+		t.Fatalf("expected restored value to go stale, read %v", value)
+	}
+	stale := newVersionCache(&NilMonitor{})
+	stale.snapshot = cache.snapshot
+	err = stale.restore(32 * time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected a stale snapshot not to be restored")
+	}
+	if len(stale.Versions()) != 0 {
+		t.Fatalf("expected no versions from a stale snapshot, read %v", stale.Versions())
+	}
+}
+
+func TestVersionCacheSnapshotEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir for testing: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fetched, _ := time.Now().MarshalJSON()
+	for _, versions := range []string{`{}`, `{"canary": 2}`} {
+		cache := newVersionCache(&NilMonitor{})
+		cache.snapshot = path.Join(dir, "app.json")
+		err = ioutil.WriteFile(cache.snapshot, []byte(fmt.Sprintf(`{"fetched": %s, "versions": %v}`, fetched, versions)), 0644)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		err = cache.restore(time.Minute)
+		if err != nil {
+			t.Fatalf("error restoring snapshot: %v", err)
+		}
+		if cache.Generation() != 0 {
+			t.Fatalf("expected generation 0 after restoring nothing from %v, got %v", versions, cache.Generation())
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListenersEnv is the environment variable through which a daemon
+// names the listeners it passes to its replacement that are owned by systemd
+// (see listenersEnv), so that the replacement leaves their socket files alone
+// too.
+const systemdListenersEnv string = "MAXWELLS_DAEMON_SYSTEMD_LISTENERS"
+
+// activateListeners takes the listeners passed by systemd socket activation
+// (see sd_listen_fds(3)), if any.
+// Each is taken over by the server listening on its address, e.g. a unit
+// holding "ListenStream=/tmp/maxwells-daemon.sock" provides the listener of
+// the unix server with "-unix.socket /tmp/maxwells-daemon.sock".
+// systemd owns these sockets: their files are neither chmod'ed nor removed.
+func activateListeners() error {
+	pid := os.Getenv("LISTEN_PID")
+	count := os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if count == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	fds, err := strconv.Atoi(count)
+	if err != nil {
+		return fmt.Errorf("could not parse LISTEN_FDS: %v", err)
+	}
+	daemonListeners.mutex.Lock()
+	defer daemonListeners.mutex.Unlock()
+	for fd := 3; fd < 3+fds; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not use socket %v passed by systemd: %v", fd, err)
+		}
+		key := listener.Addr().Network() + ":" + listener.Addr().String()
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+		daemonListeners.inherited[key] = listener
+		daemonListeners.systemd[key] = true
+	}
+	return nil
+}
+
+// ownedBySystemd provides whether the listener for the given network and
+// address was created by systemd.
+func ownedBySystemd(network string, address string) bool {
+	daemonListeners.mutex.Lock()
+	defer daemonListeners.mutex.Unlock()
+	return daemonListeners.systemd[network+":"+address]
+}
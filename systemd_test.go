@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestUnixServerSystemdListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "maxwells-daemon.sock")
+	// a socket as created by systemd
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filename, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	os.Chmod(filename, 0660)
+	key := "unix:" + filename
+	daemonListeners.mutex.Lock()
+	daemonListeners.inherited[key] = listener
+	daemonListeners.systemd[key] = true
+	daemonListeners.mutex.Unlock()
+	defer func() {
+		daemonListeners.mutex.Lock()
+		delete(daemonListeners.systemd, key)
+		daemonListeners.mutex.Unlock()
+	}()
+
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, filename, 0666, -1, -1, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("Expected the socket to keep mode 0660, got %v (%v)", info.Mode().Perm(), err)
+	}
+	server.Close()
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("Expected the socket to be left for systemd: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenersEnv is the environment variable through which a daemon names the
+// listeners it passes to its replacement, as a comma-separated list of
+// "<network>:<address>" keys; the listener of the nth key is file descriptor
+// 3+n.
+const listenersEnv string = "MAXWELLS_DAEMON_LISTENERS"
+
+// readyEnv is the environment variable holding the file descriptor through
+// which a replacement reports that it is serving.
+const readyEnv string = "MAXWELLS_DAEMON_READY_FD"
+
+// A listenerSet holds every listener of the daemon, so that they can be
+// passed to a replacement process, along with any listeners passed by the
+// process this one replaced or by systemd.
+type listenerSet struct {
+	mutex     *sync.Mutex
+	inherited map[string]net.Listener
+	active    map[string]net.Listener
+	systemd   map[string]bool
+	ready     *os.File
+}
+
+// daemonListeners holds the listeners of this process.
+var daemonListeners = &listenerSet{
+	mutex:     &sync.Mutex{},
+	inherited: make(map[string]net.Listener),
+	active:    make(map[string]net.Listener),
+	systemd:   make(map[string]bool),
+}
+
+// listen provides the listener for the given network ("tcp" or "unix") and
+// address, taking over the listener passed by the process this one replaced
+// if there is one.
+func listen(network string, address string) (net.Listener, error) {
+	key := network + ":" + address
+	daemonListeners.mutex.Lock()
+	defer daemonListeners.mutex.Unlock()
+	listener, ok := daemonListeners.inherited[key]
+	if ok {
+		delete(daemonListeners.inherited, key)
+	} else {
+		var err error
+		listener, err = net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if unixListener, ok := listener.(*net.UnixListener); ok && !daemonListeners.systemd[key] {
+		// this process now owns the socket file
+		unixListener.SetUnlinkOnClose(true)
+	}
+	daemonListeners.active[key] = listener
+	return listener, nil
+}
+
+// inherits provides whether a listener for the given network and address was
+// passed by the process this one replaced (and is not yet taken over).
+func inherits(network string, address string) bool {
+	daemonListeners.mutex.Lock()
+	defer daemonListeners.mutex.Unlock()
+	_, ok := daemonListeners.inherited[network+":"+address]
+	return ok
+}
+
+// inheritListeners takes the listeners passed through the environment by the
+// process this one replaced, if any.
+func inheritListeners() error {
+	keys := os.Getenv(listenersEnv)
+	ready := os.Getenv(readyEnv)
+	systemd := os.Getenv(systemdListenersEnv)
+	os.Unsetenv(listenersEnv)
+	os.Unsetenv(readyEnv)
+	os.Unsetenv(systemdListenersEnv)
+	daemonListeners.mutex.Lock()
+	defer daemonListeners.mutex.Unlock()
+	if systemd != "" {
+		for _, key := range strings.Split(systemd, ",") {
+			daemonListeners.systemd[key] = true
+		}
+	}
+	if ready != "" {
+		fd, err := strconv.Atoi(ready)
+		if err != nil {
+			return fmt.Errorf("could not parse %v: %v", readyEnv, err)
+		}
+		daemonListeners.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	if keys == "" {
+		return nil
+	}
+	for i, key := range strings.Split(keys, ",") {
+		file := os.NewFile(uintptr(3+i), key)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not inherit listener \"%v\": %v", key, err)
+		}
+		daemonListeners.inherited[key] = listener
+	}
+	return nil
+}
+
+// notifyReady reports to the process this one replaced (if any) and to
+// systemd (if it started the daemon with Type=notify) that this process is
+// serving, and closes any inherited listener that was not taken over.
+// systemd is also told that this is now the daemon's main process, so that an
+// upgrade is not mistaken for the daemon exiting (which requires
+// NotifyAccess=all).
+func notifyReady() {
+	daemonListeners.mutex.Lock()
+	defer daemonListeners.mutex.Unlock()
+	for key, listener := range daemonListeners.inherited {
+		if unixListener, ok := listener.(*net.UnixListener); ok && !daemonListeners.systemd[key] {
+			// the socket is no longer configured
+			unixListener.SetUnlinkOnClose(true)
+		}
+		listener.Close()
+		delete(daemonListeners.inherited, key)
+	}
+	if daemonListeners.ready != nil {
+		daemonListeners.ready.Write([]byte{1})
+		daemonListeners.ready.Close()
+		daemonListeners.ready = nil
+	}
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" {
+		connection, err := net.Dial("unixgram", socket)
+		if err != nil {
+			log.Printf("server: could not notify systemd: %v\n", err)
+			return
+		}
+		defer connection.Close()
+		fmt.Fprintf(connection, "READY=1\nMAINPID=%v\n", os.Getpid())
+	}
+}
+
+// handover provides a duplicate of every open listener along with its key,
+// and stops Unix listeners from removing their socket files when closed.
+// The keys of listeners owned by systemd are also provided.
+func (set *listenerSet) handover() ([]string, []*os.File, []string) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	var keys []string
+	var files []*os.File
+	var systemd []string
+	for key, listener := range set.active {
+		var file *os.File
+		var err error
+		switch listener := listener.(type) {
+		case *net.UnixListener:
+			file, err = listener.File()
+			if err == nil {
+				listener.SetUnlinkOnClose(false)
+			}
+		case *net.TCPListener:
+			file, err = listener.File()
+		default:
+			continue
+		}
+		if err != nil {
+			// the listener has been closed
+			delete(set.active, key)
+			continue
+		}
+		keys = append(keys, key)
+		files = append(files, file)
+		if set.systemd[key] {
+			systemd = append(systemd, key)
+		}
+	}
+	return keys, files, systemd
+}
+
+// reclaim lets Unix listeners remove their socket files when closed again,
+// once a handover has failed.
+func (set *listenerSet) reclaim() {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	for key, listener := range set.active {
+		if unixListener, ok := listener.(*net.UnixListener); ok && !set.systemd[key] {
+			unixListener.SetUnlinkOnClose(true)
+		}
+	}
+}
+
+// Upgrade starts a new daemon process from the (possibly replaced) executable
+// with the same arguments, passes it every listener, and waits up to the
+// given timeout for it to report that it is serving.
+// Connections arriving in the meantime wait in the listeners' backlogs, so
+// none are refused; once Upgrade returns successfully this process should
+// drain its connections and exit.
+// If the new process fails to start in time it is killed, and this process
+// keeps serving.
+func Upgrade(timeout time.Duration) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %v", err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("could not create pipe: %v", err)
+	}
+	defer readyReader.Close()
+	keys, files, systemd := daemonListeners.handover()
+	var env []string
+	for _, entry := range os.Environ() {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if name != listenersEnv && name != readyEnv && name != systemdListenersEnv {
+			env = append(env, entry)
+		}
+	}
+	env = append(env, listenersEnv+"="+strings.Join(keys, ","), fmt.Sprintf("%v=%v", readyEnv, 3+len(files)), systemdListenersEnv+"="+strings.Join(systemd, ","))
+	command := exec.Command(executable, os.Args[1:]...)
+	command.Env = env
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.ExtraFiles = append(files, readyWriter)
+	err = command.Start()
+	for _, file := range command.ExtraFiles {
+		file.Close()
+	}
+	if err != nil {
+		daemonListeners.reclaim()
+		return fmt.Errorf("could not start %v: %v", executable, err)
+	}
+	go command.Wait()
+	readyReader.SetReadDeadline(time.Now().Add(timeout))
+	count, err := readyReader.Read(make([]byte, 1))
+	if count != 1 {
+		command.Process.Kill()
+		daemonListeners.reclaim()
+		return fmt.Errorf("new process %v did not become ready: %v", command.Process.Pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestListenerHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "maxwells-daemon.sock")
+	old, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, filename, 0666, -1, -1, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+
+	// hand the listener over as if to a new process
+	keys, files, _ := daemonListeners.handover()
+	defer daemonListeners.reclaim()
+	for i, key := range keys {
+		if key == "unix:"+filename {
+			listener, err := net.FileListener(files[i])
+			if err != nil {
+				t.Fatalf("could not inherit listener: %v", err)
+			}
+			daemonListeners.mutex.Lock()
+			daemonListeners.inherited[key] = listener
+			daemonListeners.mutex.Unlock()
+		}
+		files[i].Close()
+	}
+	if !inherits("unix", filename) {
+		t.Fatalf("Expected \"%v\" to be inherited, got %v", filename, keys)
+	}
+	old.Close()
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("Expected the socket to outlive the old server: %v", err)
+	}
+	// connections made between the servers wait in the backlog
+	connection, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatalf("error connecting between servers: %v", err)
+	}
+	defer connection.Close()
+
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, filename, 0666, -1, -1, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	if inherits("unix", filename) {
+		t.Fatalf("Expected the inherited listener to be taken over")
+	}
+	connection.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(connection, "0.5\n")
+	response, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil || response != "0.5\n" {
+		t.Fatalf("Expected \"0.5\\n\", got %q (%v)", response, err)
+	}
+	server.Close()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed by the last server, got %v", err)
+	}
+}
+
+func TestListenerReclaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxwells-daemon-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "maxwells-daemon.sock")
+	server, err := NewUnixServer(&NilMonitor{}, &EchoHandler{}, filename, 0666, -1, -1, 0)
+	if err != nil {
+		t.Fatalf("error starting server: %v", err)
+	}
+	// a failed upgrade leaves the socket owned by this process
+	_, files, _ := daemonListeners.handover()
+	for _, file := range files {
+		file.Close()
+	}
+	daemonListeners.reclaim()
+	server.Close()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed, got %v", err)
+	}
+}